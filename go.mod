@@ -2,7 +2,6 @@ module github.com/DumbCaveSpider/GDAlternativeWeb
 
 go 1.21.0
 
-require (
-	filippo.io/edwards25519 v1.1.0 // indirect
-	github.com/go-sql-driver/mysql v1.9.3 // indirect
-)
+require github.com/go-sql-driver/mysql v1.9.3
+
+require filippo.io/edwards25519 v1.1.0 // indirect
@@ -1,14 +1,26 @@
 package log
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var LogLevel int = 0
-var cached bool = false
+const (
+	LevelDebug = 0
+	LevelInfo  = 1
+	LevelWarn  = 2
+	LevelError = 3
+	LevelDone  = 4
+	LevelPrint = 5
+)
 
 const (
 	reset  = "\033[0m"
@@ -19,82 +31,252 @@ const (
 	green  = "\033[32m"
 )
 
-func getLogLevel() int {
-	if cached {
-		return LogLevel
-	} else {
-		level := os.Getenv("LOG_LEVEL")
+var (
+	level     atomic.Int32
+	format    atomic.Value // string: "text", "json" or "logfmt"
+	initOnce  sync.Once
+	writeMu   sync.Mutex
+	out       io.Writer = os.Stdout
+	useColors bool
+)
+
+// Logger carries a set of key-value fields that are attached to every line it writes.
+type Logger struct {
+	fields []any
+}
+
+var root = &Logger{}
 
-		if level != "" {
-			val, err := strconv.Atoi(level)
+type ctxKey struct{}
+type requestIDKey struct{}
 
-			if err == nil {
-				LogLevel = val
+func setup() {
+	initOnce.Do(func() {
+		lvl := LevelDebug
+		if v := os.Getenv("LOG_LEVEL"); v != "" {
+			if parsed, ok := ParseLevel(v); ok {
+				lvl = parsed
 			} else {
-				LogLevel = 1
+				lvl = LevelInfo
 			}
-		} else {
-			LogLevel = 0
 		}
+		level.Store(int32(lvl))
 
-		cached = true
-		return LogLevel
+		f := strings.ToLower(os.Getenv("LOG_FORMAT"))
+		if f != "json" && f != "logfmt" {
+			f = "text"
+		}
+		format.Store(f)
+
+		if fi, err := os.Stdout.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+			useColors = true
+		}
+	})
+}
+
+// ParseLevel accepts either a number (0=Debug ... 5=Print) or a level name.
+func ParseLevel(s string) (int, bool) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if n, err := strconv.Atoi(s); err == nil {
+		return n, true
+	}
+	switch s {
+	case "debug":
+		return LevelDebug, true
+	case "info":
+		return LevelInfo, true
+	case "warn", "warning":
+		return LevelWarn, true
+	case "error":
+		return LevelError, true
+	case "done":
+		return LevelDone, true
+	case "print", "log":
+		return LevelPrint, true
 	}
+	return 0, false
 }
 
-func writeConsole(color string, tag string, format any, a ...any) {
-	utc := time.Now().UTC()
-	timeStamp := fmt.Sprintf("%s UTC", utc.Format(time.RFC3339))
+// Level returns the current minimum level.
+func Level() int {
+	setup()
+	return int(level.Load())
+}
 
-	level := fmt.Sprintf("%s| %s |", color, tag)
+// SetLevel changes the minimum level at runtime.
+func SetLevel(lvl int) {
+	setup()
+	level.Store(int32(lvl))
+}
 
-	var message string
-	switch v := format.(type) {
-	case string:
-		if len(a) > 0 {
-			message = fmt.Sprintf(v, a...)
-		} else {
-			message = v
+// SetFormat switches output between "text", "json" and "logfmt".
+func SetFormat(f string) {
+	setup()
+	switch f {
+	case "json", "logfmt", "text":
+		format.Store(f)
+	}
+}
+
+// With returns a logger that adds the given key-value pairs to each line.
+func With(kv ...any) *Logger {
+	return root.With(kv...)
+}
+
+func (l *Logger) With(kv ...any) *Logger {
+	if l == nil {
+		l = root
+	}
+	fields := make([]any, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{fields: fields}
+}
+
+// NewContext stores the logger in ctx.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger stored in ctx, or the root logger.
+func FromContext(ctx context.Context) *Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*Logger); ok && l != nil {
+			return l
 		}
-	default:
-		message = fmt.Sprint(format)
 	}
+	return root
+}
 
-	fmt.Println(timeStamp, level, message, reset)
+// WithRequestID stores the request ID in ctx and attaches it to the context logger.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	ctx = context.WithValue(ctx, requestIDKey{}, id)
+	return NewContext(ctx, FromContext(ctx).With("request_id", id))
 }
 
-func Debug(format any, a ...any) {
-	if getLogLevel() <= 0 {
-		writeConsole(gray, "DEBUG", format, a...)
+// RequestID returns the request ID stored in ctx, if any.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
 	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
 }
 
-func Info(format any, a ...any) {
-	if getLogLevel() <= 1 {
-		writeConsole(blue, "INFO", format, a...)
+func levelName(lvl int) string {
+	switch lvl {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	case LevelDone:
+		return "done"
 	}
+	return "log"
 }
 
-func Warn(format any, a ...any) {
-	if getLogLevel() <= 2 {
-		writeConsole(yellow, "WARN", format, a...)
+func formatMessage(f any, a ...any) string {
+	switch v := f.(type) {
+	case string:
+		if len(a) > 0 {
+			return fmt.Sprintf(v, a...)
+		}
+		return v
+	default:
+		return fmt.Sprint(f)
 	}
 }
 
-func Error(format any, a ...any) {
-	if getLogLevel() <= 3 {
-		writeConsole(red, "ERROR", format, a...)
+func fieldValue(v any) any {
+	switch t := v.(type) {
+	case time.Duration:
+		return t.String()
+	case error:
+		return t.Error()
+	case fmt.Stringer:
+		return t.String()
 	}
+	return v
 }
 
-func Done(format any, a ...any) {
-	if getLogLevel() <= 4 {
-		writeConsole(green, "DONE", format, a...)
+func logfmtValue(v any) string {
+	s := fmt.Sprint(fieldValue(v))
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return strconv.Quote(s)
 	}
+	return s
 }
 
-func Print(format any, a ...any) {
-	if getLogLevel() <= 5 {
-		writeConsole(reset, " LOG ", format, a...)
+func (l *Logger) write(lvl int, color string, tag string, f any, a ...any) {
+	setup()
+	if lvl < int(level.Load()) {
+		return
 	}
+
+	now := time.Now().UTC()
+	message := formatMessage(f, a...)
+	var fields []any
+	if l != nil {
+		fields = l.fields
+	}
+
+	var line string
+	switch format.Load().(string) {
+	case "json":
+		entry := make(map[string]any, 3+len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			entry[fmt.Sprint(fields[i])] = fieldValue(fields[i+1])
+		}
+		entry["time"] = now.Format(time.RFC3339Nano)
+		entry["level"] = levelName(lvl)
+		entry["msg"] = message
+		b, err := json.Marshal(entry)
+		if err != nil {
+			b = []byte(fmt.Sprintf(`{"time":%q,"level":"error","msg":"log marshal error: %v"}`, now.Format(time.RFC3339Nano), err))
+		}
+		line = string(b)
+	case "logfmt":
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "time=%s level=%s msg=%s", now.Format(time.RFC3339Nano), levelName(lvl), strconv.Quote(message))
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&sb, " %v=%s", fields[i], logfmtValue(fields[i+1]))
+		}
+		line = sb.String()
+	default:
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "%s UTC ", now.Format(time.RFC3339))
+		if useColors {
+			sb.WriteString(color)
+		}
+		fmt.Fprintf(&sb, "| %s | %s", tag, message)
+		for i := 0; i+1 < len(fields); i += 2 {
+			fmt.Fprintf(&sb, " %v=%s", fields[i], logfmtValue(fields[i+1]))
+		}
+		if useColors {
+			sb.WriteString(" " + reset)
+		}
+		line = sb.String()
+	}
+
+	writeMu.Lock()
+	fmt.Fprintln(out, line)
+	writeMu.Unlock()
 }
+
+func (l *Logger) Debug(format any, a ...any) { l.write(LevelDebug, gray, "DEBUG", format, a...) }
+func (l *Logger) Info(format any, a ...any)  { l.write(LevelInfo, blue, "INFO", format, a...) }
+func (l *Logger) Warn(format any, a ...any)  { l.write(LevelWarn, yellow, "WARN", format, a...) }
+func (l *Logger) Error(format any, a ...any) { l.write(LevelError, red, "ERROR", format, a...) }
+func (l *Logger) Done(format any, a ...any)  { l.write(LevelDone, green, "DONE", format, a...) }
+func (l *Logger) Print(format any, a ...any) { l.write(LevelPrint, reset, " LOG ", format, a...) }
+
+func Debug(format any, a ...any) { root.Debug(format, a...) }
+func Info(format any, a ...any)  { root.Info(format, a...) }
+func Warn(format any, a ...any)  { root.Warn(format, a...) }
+func Error(format any, a ...any) { root.Error(format, a...) }
+func Done(format any, a ...any)  { root.Done(format, a...) }
+func Print(format any, a ...any) { root.Print(format, a...) }
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Account operations shared by the admin API and operator tooling.
+
+var errAccountNotFound = errors.New("account not found")
+
+type accountInfo struct {
+	AccountID        string           `json:"accountId"`
+	CreatedAt        *time.Time       `json:"createdAt"`
+	TokenValidatedAt *time.Time       `json:"tokenValidatedAt"`
+	LastActivity     *time.Time       `json:"lastActivity"`
+	Subscriber       bool             `json:"subscriber"`
+	HasBackup        bool             `json:"hasBackup"`
+	DeletedAt        *time.Time       `json:"deletedAt,omitempty"`
+	SaveDataBytes    int64            `json:"saveDataBytes"`
+	LevelDataBytes   int64            `json:"levelDataBytes"`
+	TotalBytes       int64            `json:"totalBytes"`
+	MaxDataSize      int              `json:"maxDataSize"`
+	Tier             *tier            `json:"tier"`
+	LastSaved        *time.Time       `json:"lastSaved"`
+	Memberships      []membershipInfo `json:"memberships"`
+}
+
+type membershipInfo struct {
+	ID                int64      `json:"id"`
+	Email             string     `json:"email"`
+	TierName          string     `json:"tierName"`
+	KofiTransactionID string     `json:"kofiTransactionId"`
+	ExpiresAt         *time.Time `json:"expiresAt"`
+	CreatedAt         *time.Time `json:"createdAt"`
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	v := t.Time
+	return &v
+}
+
+func lookupAccount(ctx context.Context, db *sql.DB, accountID string) (*accountInfo, error) {
+	info := &accountInfo{AccountID: accountID, Memberships: []membershipInfo{}}
+
+	var createdAt, validatedAt, lastActivity sql.NullTime
+	var subscriber sql.NullBool
+	err := db.QueryRowContext(ctx, "SELECT created_at, token_validated_at, last_activity_at, subscriber FROM accounts WHERE account_id = ?", accountID).Scan(&createdAt, &validatedAt, &lastActivity, &subscriber)
+	if err == sql.ErrNoRows {
+		return nil, errAccountNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("account lookup: %w", err)
+	}
+	info.CreatedAt = nullTimePtr(createdAt)
+	info.TokenValidatedAt = nullTimePtr(validatedAt)
+	info.LastActivity = nullTimePtr(lastActivity)
+	info.Subscriber = subscriber.Valid && subscriber.Bool
+	if info.Tier, err = accountTier(ctx, db, accountID); err != nil {
+		return nil, err
+	}
+	info.MaxDataSize = info.Tier.MaxDataSize
+
+	var saveBytes, levelBytes sql.NullInt64
+	var lastSaved, deletedAt sql.NullTime
+	err = db.QueryRowContext(ctx, "SELECT LENGTH(save_data), LENGTH(level_data), created_at, deleted_at FROM saves WHERE account_id = ?", accountID).Scan(&saveBytes, &levelBytes, &lastSaved, &deletedAt)
+	switch {
+	case err == sql.ErrNoRows:
+	case err != nil:
+		return nil, fmt.Errorf("save lookup: %w", err)
+	default:
+		info.HasBackup = !deletedAt.Valid
+		info.DeletedAt = nullTimePtr(deletedAt)
+		info.SaveDataBytes = saveBytes.Int64
+		info.LevelDataBytes = levelBytes.Int64
+		info.TotalBytes = saveBytes.Int64 + levelBytes.Int64
+		info.LastSaved = nullTimePtr(lastSaved)
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT id, email, tier_name, kofi_transaction_id, expires_at, created_at FROM memberships WHERE account_id = ? ORDER BY id DESC", accountID)
+	if err != nil {
+		return nil, fmt.Errorf("membership lookup: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m membershipInfo
+		var email, tier, txn sql.NullString
+		var expires, created sql.NullTime
+		if err := rows.Scan(&m.ID, &email, &tier, &txn, &expires, &created); err != nil {
+			return nil, fmt.Errorf("membership scan: %w", err)
+		}
+		m.Email = email.String
+		m.TierName = tier.String
+		m.KofiTransactionID = txn.String
+		m.ExpiresAt = nullTimePtr(expires)
+		m.CreatedAt = nullTimePtr(created)
+		info.Memberships = append(info.Memberships, m)
+	}
+	return info, rows.Err()
+}
+
+// deleteBackup moves the stored save and level data of an account to the trash,
+// where it can be recovered until RECOVERY_WINDOW_DAYS pass. It reports whether
+// a backup existed.
+func deleteBackup(ctx context.Context, db *sql.DB, accountID string) (bool, error) {
+	res, err := db.ExecContext(ctx, "UPDATE saves SET deleted_at = CURRENT_TIMESTAMP WHERE account_id = ? AND deleted_at IS NULL", accountID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// undeleteBackup takes an account's backup out of the trash if it was deleted
+// within the recovery window. It reports whether there was anything to restore.
+func undeleteBackup(ctx context.Context, db *sql.DB, accountID string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE saves SET deleted_at = NULL WHERE account_id = ? AND deleted_at > DATE_SUB(NOW(), INTERVAL ? DAY)", accountID, cfg().RecoveryWindowDays)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE accounts SET deleted_at = NULL WHERE account_id = ?", accountID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// discardTrash permanently removes a trashed backup so a new one can take its
+// place, and takes the account itself out of the trash. It runs in the
+// transaction that writes the new backup.
+func discardTrash(ctx context.Context, tx *sql.Tx, accountID string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM saves WHERE account_id = ? AND deleted_at IS NOT NULL", accountID); err != nil {
+		return fmt.Errorf("discard trash: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE accounts SET deleted_at = NULL WHERE account_id = ? AND deleted_at IS NOT NULL", accountID); err != nil {
+		return fmt.Errorf("discard trash: %w", err)
+	}
+	return nil
+}
+
+// restoreBackup writes save and/or level data for an existing account,
+// replacing whatever is stored. Empty fields are left untouched.
+func restoreBackup(ctx context.Context, db *sql.DB, accountID, saveData, levelData string) error {
+	var exists int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE account_id = ?", accountID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errAccountNotFound
+	}
+	return writeBackup(ctx, db, accountID, saveData, levelData)
+}
+
+func setSubscriber(ctx context.Context, db *sql.DB, accountID string, subscriber bool) error {
+	res, err := db.ExecContext(ctx, "UPDATE accounts SET subscriber = ? WHERE account_id = ?", subscriber, accountID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE account_id = ?", accountID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errAccountNotFound
+		}
+	}
+	return nil
+}
+
+// extendMembership grants the account's latest membership the given number of
+// days through a manual ledger entry, counted from its current expiry or from
+// now if it has lapsed. It returns the new expiry.
+func extendMembership(ctx context.Context, db *sql.DB, accountID string, days int) (time.Time, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM memberships WHERE account_id = ? ORDER BY id DESC LIMIT 1 FOR UPDATE", accountID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return time.Time{}, fmt.Errorf("no membership linked to account %s", accountID)
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := addManualPayment(ctx, tx, id, days); err != nil {
+		return time.Time{}, err
+	}
+	newExpiry, _, err := syncMembershipExpiry(ctx, tx, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return newExpiry, tx.Commit()
+}
+
+// touchActivity records that the account just authenticated. Cleanup removes
+// accounts by last activity, so any authenticated request keeps a backup alive.
+// An account the cleanup already moved to the trash is taken back out, along
+// with the backup trashed with it, so activity inside the recovery window
+// saves it from the purge. A backup the owner deleted earlier stays in the
+// trash. Writes are throttled to one every few minutes per account.
+func touchActivity(ctx context.Context, db *sql.DB, accountID string) {
+	if err := recordActivity(ctx, db, accountID); err != nil {
+		log.FromContext(ctx).Warn("auth: failed to record activity for %s: %v", accountID, err)
+	}
+}
+
+func recordActivity(ctx context.Context, db *sql.DB, accountID string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE accounts SET last_activity_at = CURRENT_TIMESTAMP WHERE account_id = ? AND (last_activity_at IS NULL OR last_activity_at < DATE_SUB(NOW(), INTERVAL 5 MINUTE))", accountID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	// The cleanup trashes a chunk's saves just before its accounts, so a save
+	// trashed shortly before the account went with it
+	_, err = tx.ExecContext(ctx, `UPDATE saves s JOIN accounts a ON a.account_id = s.account_id
+		SET s.deleted_at = NULL
+		WHERE s.account_id = ? AND a.deleted_at IS NOT NULL AND s.deleted_at >= DATE_SUB(a.deleted_at, INTERVAL 1 MINUTE)`, accountID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE accounts SET deleted_at = NULL WHERE account_id = ? AND deleted_at IS NOT NULL", accountID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ensureAccount creates an account row without a token if it doesn't exist yet.
+// The token is filled in on the next successful Argon validation.
+func ensureAccount(ctx context.Context, db *sql.DB, accountID string) error {
+	_, err := db.ExecContext(ctx, "INSERT IGNORE INTO accounts (account_id, argon_token) VALUES (?, '')", accountID)
+	return err
+}
+
+type backupExport struct {
+	AccountID string     `json:"accountId"`
+	SaveData  string     `json:"saveData"`
+	LevelData string     `json:"levelData"`
+	LastSaved *time.Time `json:"lastSaved"`
+}
+
+func exportBackup(ctx context.Context, db *sql.DB, accountID string) (*backupExport, error) {
+	out := &backupExport{AccountID: accountID}
+	var saveData, levelData sql.NullString
+	var lastSaved sql.NullTime
+	err := db.QueryRowContext(ctx, "SELECT save_data, level_data, created_at FROM saves WHERE account_id = ? AND deleted_at IS NULL", accountID).Scan(&saveData, &levelData, &lastSaved)
+	if err == sql.ErrNoRows {
+		return nil, errAccountNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	out.SaveData = saveData.String
+	out.LevelData = levelData.String
+	out.LastSaved = nullTimePtr(lastSaved)
+	return out, nil
+}
+
+// grantMembership extends the account's membership by days, creating a linked
+// membership row if the account has none.
+func grantMembership(ctx context.Context, db *sql.DB, accountID, email, tier string, days int) (time.Time, error) {
+	var count int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memberships WHERE account_id = ?", accountID).Scan(&count); err != nil {
+		return time.Time{}, err
+	}
+	if count > 0 {
+		return extendMembership(ctx, db, accountID, days)
+	}
+
+	if tier == "" {
+		tier = defaultTierName
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+	if err := ensureTier(ctx, tx, tier); err != nil {
+		return time.Time{}, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO memberships (email, tier_name, account_id, expires_at) VALUES (?, ?, ?, NOW())", email, tier, accountID)
+	if err != nil {
+		return time.Time{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := addManualPayment(ctx, tx, id, days); err != nil {
+		return time.Time{}, err
+	}
+	newExpiry, _, err := syncMembershipExpiry(ctx, tx, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return newExpiry, tx.Commit()
+}
+
+// revokeMembership ends every active membership linked to the account, or with
+// days > 0 shortens them by that many days instead. Both are recorded in the
+// ledger, so later payments still count from the new expiry. Lifetime
+// memberships can only be ended. It returns the number of memberships changed.
+func revokeMembership(ctx context.Context, db *sql.DB, accountID string, days int) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, expires_at IS NULL FROM memberships WHERE account_id = ? AND (expires_at > NOW() OR expires_at IS NULL) FOR UPDATE", accountID)
+	if err != nil {
+		return 0, err
+	}
+	type active struct {
+		id       int64
+		lifetime bool
+	}
+	var memberships []active
+	for rows.Next() {
+		var m active
+		if err := rows.Scan(&m.id, &m.lifetime); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		memberships = append(memberships, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var n int64
+	for _, m := range memberships {
+		switch {
+		case days > 0 && m.lifetime:
+			continue
+		case days > 0:
+			err = addManualPayment(ctx, tx, m.id, -days)
+		default:
+			if m.lifetime {
+				// Give the ledger an expiry to work with
+				if _, err := tx.ExecContext(ctx, "UPDATE memberships SET expires_at = NOW() WHERE id = ?", m.id); err != nil {
+					return 0, err
+				}
+			}
+			err = addCancellation(ctx, tx, m.id, "manual", newRequestID())
+		}
+		if err != nil {
+			return 0, err
+		}
+		if _, _, err := syncMembershipExpiry(ctx, tx, m.id); err != nil {
+			return 0, err
+		}
+		n++
+	}
+	if days <= 0 {
+		// Subscribers without a membership lose their status too
+		if err := refreshSubscriber(ctx, tx, accountID); err != nil {
+			return 0, err
+		}
+		if err := updateQuotaState(ctx, tx, accountID); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+type membershipListEntry struct {
+	membershipInfo
+	AccountID string `json:"accountId"`
+}
+
+// listMemberships returns memberships, optionally filtered by account and to
+// those that haven't expired.
+func listMemberships(ctx context.Context, db *sql.DB, accountID string, activeOnly bool) ([]membershipListEntry, error) {
+	query := "SELECT id, email, tier_name, kofi_transaction_id, account_id, expires_at, created_at FROM memberships WHERE 1=1"
+	var args []interface{}
+	if accountID != "" {
+		query += " AND account_id = ?"
+		args = append(args, accountID)
+	}
+	if activeOnly {
+		query += " AND (expires_at > NOW() OR expires_at IS NULL)"
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []membershipListEntry{}
+	for rows.Next() {
+		var m membershipListEntry
+		var email, tier, txn, acct sql.NullString
+		var expires, created sql.NullTime
+		if err := rows.Scan(&m.ID, &email, &tier, &txn, &acct, &expires, &created); err != nil {
+			return nil, err
+		}
+		m.Email = email.String
+		m.TierName = tier.String
+		m.KofiTransactionID = txn.String
+		m.AccountID = acct.String
+		m.ExpiresAt = nullTimePtr(expires)
+		m.CreatedAt = nullTimePtr(created)
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+type instanceStats struct {
+	Accounts          int64 `json:"accounts"`
+	Subscribers       int64 `json:"subscribers"`
+	Backups           int64 `json:"backups"`
+	TrashedBackups    int64 `json:"trashedBackups"`
+	StoredBytes       int64 `json:"storedBytes"`
+	ActiveMemberships int64 `json:"activeMemberships"`
+}
+
+func collectStats(ctx context.Context, db *sql.DB) (*instanceStats, error) {
+	st := &instanceStats{}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(subscriber = 1), 0) FROM accounts").Scan(&st.Accounts, &st.Subscribers); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(SUM(deleted_at IS NULL), 0), COALESCE(SUM(deleted_at IS NOT NULL), 0), COALESCE(SUM(LENGTH(save_data) + LENGTH(level_data)), 0) FROM saves").Scan(&st.Backups, &st.TrashedBackups, &st.StoredBytes); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memberships WHERE account_id IS NOT NULL AND account_id != '' AND (expires_at > NOW() OR expires_at IS NULL)").Scan(&st.ActiveMemberships); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Operator-only endpoints live under /admin and require
+// "Authorization: Bearer <ADMIN_TOKEN>". They are disabled when no token is set.
+
+func init() {
+	http.HandleFunc("/admin/config/reload", adminMiddleware(adminReloadConfigHandler))
+	http.HandleFunc("/admin/account", adminMiddleware(adminAccountHandler))
+	http.HandleFunc("/admin/account/delete", adminMiddleware(adminDeleteBackupHandler))
+	http.HandleFunc("/admin/account/restore", adminMiddleware(adminRestoreBackupHandler))
+	http.HandleFunc("/admin/account/subscriber", adminMiddleware(adminSubscriberHandler))
+	http.HandleFunc("/admin/membership/extend", adminMiddleware(adminExtendMembershipHandler))
+	http.HandleFunc("/admin/membership/revoke", adminMiddleware(adminRevokeMembershipHandler))
+	http.HandleFunc("/admin/membership/transfer", adminMiddleware(adminTransferMembershipHandler))
+	http.HandleFunc("/admin/payments/refund", adminMiddleware(adminRefundPaymentHandler))
+	http.HandleFunc("/admin/cleanup", adminMiddleware(adminCleanupHandler))
+	http.HandleFunc("/admin/cleanup/reports", adminMiddleware(adminCleanupReportsHandler))
+	http.HandleFunc("/admin/jobs", adminMiddleware(adminJobsHandler))
+	http.HandleFunc("/admin/jobs/run", adminMiddleware(adminRunJobHandler))
+	http.HandleFunc("/admin/tiers", adminMiddleware(adminTiersHandler))
+}
+
+// adminAuditAccount is used as the account ID for audit events that don't
+// concern a single account.
+const adminAuditAccount = "*"
+
+type adminRequest struct {
+	AccountId  string `json:"accountId"`
+	SaveData   string `json:"saveData"`
+	LevelData  string `json:"levelData"`
+	Subscriber *bool  `json:"subscriber"`
+	Days       int    `json:"days"`
+	Job        string `json:"job"`
+
+	// /admin/membership/transfer; without a target the memberships are unlinked
+	TargetAccountId string `json:"targetAccountId"`
+	Email           string `json:"email"`
+
+	// /admin/payments/refund
+	Provider      string `json:"provider"`
+	TransactionID string `json:"transactionId"`
+
+	// /admin/tiers; omitted limits fall back to the config defaults
+	Tier          string `json:"tier"`
+	MaxDataSize   *int   `json:"maxDataSize"`
+	RetentionDays *int   `json:"retentionDays"`
+	SavesPerHour  *int   `json:"savesPerHour"`
+	LoadsPerHour  *int   `json:"loadsPerHour"`
+}
+
+func adminMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := cfg().AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		reqToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			log.FromContext(r.Context()).Warn("admin: unauthorized request to %s from %s", r.URL.Path, clientIP(r))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminReloadConfigHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	res, err := reloadConfig()
+	if err != nil {
+		logger.Error("admin: config reload failed: %v", err)
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": err.Error(),
+		})
+		return
+	}
+	logger.Info("admin: configuration reloaded (%d changed, %d require restart)", len(res.Changed), len(res.RequiresRestart))
+	writeJSON(w, http.StatusOK, res)
+}
+
+// decodeAdminRequest reads a JSON body and requires accountId to be set.
+func decodeAdminRequest(w http.ResponseWriter, r *http.Request) (*adminRequest, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.FromContext(r.Context()).Warn("admin: json decode error: %v", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return nil, false
+	}
+	if req.AccountId == "" {
+		http.Error(w, "Missing Account ID", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+func adminDB(w http.ResponseWriter, r *http.Request) *sql.DB {
+	db := DB
+	if db == nil {
+		log.FromContext(r.Context()).Error("admin: DB not initialized")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+	return db
+}
+
+func adminAccountHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	accountID := r.URL.Query().Get("accountId")
+	if accountID == "" {
+		http.Error(w, "Missing Account ID", http.StatusBadRequest)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_view", accountID)
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	info, err := lookupAccount(ctx, db, accountID)
+	if errors.Is(err, errAccountNotFound) {
+		audit.Result = "not_found"
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("admin: account lookup error for %s: %v", accountID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, info)
+}
+
+func adminDeleteBackupHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_delete", req.AccountId)
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	existed, err := deleteBackup(ctx, db, req.AccountId)
+	if err != nil {
+		logger.Error("admin: delete backup error for %s: %v", req.AccountId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !existed {
+		audit.Result = "not_found"
+		http.Error(w, "Backup not found", http.StatusNotFound)
+		return
+	}
+	logger.Info("admin: deleted backup for %s", req.AccountId)
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"deleted": true})
+}
+
+func adminRestoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.SaveData == "" && req.LevelData == "" {
+		http.Error(w, "Missing Data", http.StatusBadRequest)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_restore", req.AccountId)
+	audit.Bytes = int64(len(req.SaveData) + len(req.LevelData))
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
+	defer cancel()
+
+	err := restoreBackup(ctx, db, req.AccountId, req.SaveData, req.LevelData)
+	if errors.Is(err, errAccountNotFound) {
+		audit.Result = "not_found"
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("admin: restore backup error for %s: %v", req.AccountId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("admin: restored backup for %s (%d bytes)", req.AccountId, audit.Bytes)
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"restored": true})
+}
+
+func adminSubscriberHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Subscriber == nil {
+		http.Error(w, "Missing subscriber", http.StatusBadRequest)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_subscriber", req.AccountId)
+	if *req.Subscriber {
+		audit.Detail = "subscriber=1"
+	} else {
+		audit.Detail = "subscriber=0"
+	}
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	err := setSubscriber(ctx, db, req.AccountId, *req.Subscriber)
+	if errors.Is(err, errAccountNotFound) {
+		audit.Result = "not_found"
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("admin: subscriber update error for %s: %v", req.AccountId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("admin: set subscriber=%v for %s", *req.Subscriber, req.AccountId)
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"subscriber": *req.Subscriber})
+}
+
+func adminExtendMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Days <= 0 {
+		http.Error(w, "days must be positive", http.StatusBadRequest)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_extend", req.AccountId)
+	audit.Detail = fmt.Sprintf("days=%d", req.Days)
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	newExpiry, err := extendMembership(ctx, db, req.AccountId, req.Days)
+	if err != nil {
+		logger.Error("admin: extend membership error for %s: %v", req.AccountId, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger.Info("admin: extended membership for %s to %s", req.AccountId, newExpiry.Format(time.RFC3339))
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"expiresAt": newExpiry.Format(time.RFC3339)})
+}
+
+func adminRevokeMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	// days > 0 shortens the memberships, omitted ends them
+	if req.Days < 0 {
+		http.Error(w, "days must not be negative", http.StatusBadRequest)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_revoke", req.AccountId)
+	audit.Detail = fmt.Sprintf("days=%d", req.Days)
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	n, err := revokeMembership(ctx, db, req.AccountId, req.Days)
+	if err != nil {
+		logger.Error("admin: revoke membership error for %s: %v", req.AccountId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("admin: revoked %d membership(s) for %s (days=%d)", n, req.AccountId, req.Days)
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"memberships": n})
+}
+
+func adminTransferMembershipHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeAdminRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.TargetAccountId == req.AccountId {
+		http.Error(w, "Cannot transfer to the same account", http.StatusBadRequest)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_transfer", req.AccountId)
+	audit.Detail = req.TargetAccountId
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	// Operators aren't held to the cooldown
+	n, err := moveMemberships(ctx, db, req.AccountId, req.TargetAccountId, req.Email, true)
+	switch {
+	case errors.Is(err, errMembershipNotFound):
+		audit.Result = "not_found"
+		http.Error(w, "No linked membership", http.StatusNotFound)
+		return
+	case errors.Is(err, errAccountNotFound):
+		audit.Result = "not_found"
+		http.Error(w, "Target account not found", http.StatusNotFound)
+		return
+	case err != nil:
+		logger.Error("admin: transfer membership error for %s: %v", req.AccountId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	logger.Info("admin: moved %d membership(s) from %s to %q", n, req.AccountId, req.TargetAccountId)
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"memberships": n})
+}
+
+func adminRefundPaymentHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("admin: json decode error: %v", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.TransactionID == "" {
+		http.Error(w, "Missing transaction ID", http.StatusBadRequest)
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = kofiProvider{}.Name()
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_refund", adminAuditAccount)
+	audit.Detail = req.Provider + ":" + req.TransactionID
+	defer audit.record()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	accountID, err := refundPayment(ctx, db, req.Provider, req.TransactionID)
+	if errors.Is(err, errPaymentNotFound) {
+		audit.Result = "not_found"
+		http.Error(w, "Payment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("admin: refund error for %s: %v", audit.Detail, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if accountID != "" {
+		audit.AccountID = accountID
+	}
+	logger.Info("admin: refunded payment %s", audit.Detail)
+	audit.Result = "ok"
+	writeJSON(w, http.StatusOK, map[string]interface{}{"refunded": true, "accountId": accountID})
+}
+
+func adminCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// ?dryRun=1 returns the report synchronously without modifying anything
+	if dry, _ := strconv.ParseBool(r.URL.Query().Get("dryRun")); dry {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Minute)
+		defer cancel()
+		report, err := performCleanup(ctx, true)
+		if err != nil {
+			log.FromContext(r.Context()).Error("admin: cleanup dry run failed: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+		return
+	}
+
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+	audit := newAuditEvent(r, "admin_cleanup", adminAuditAccount)
+	defer audit.record()
+
+	if !startManualJob(w, r, db, fullCleanupJob, audit) {
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"started": true})
+}
+
+// startManualJob starts j in the background through runJob, so the run is
+// recorded in job_runs. Like scheduled runs it only happens on the replica
+// holding the scheduler lease; other replicas answer 409 naming the holder.
+// It writes the error response and reports false if the job wasn't started.
+func startManualJob(w http.ResponseWriter, r *http.Request, db *sql.DB, j job, audit *auditEvent) bool {
+	logger := log.FromContext(r.Context())
+	if !schedulerLease.isHeld() {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		holder, err := currentLeaseHolder(ctx, db, schedulerLeaseName)
+		if err != nil {
+			logger.Warn("admin: lease holder lookup error: %v", err)
+		}
+		audit.Result = "not_leader"
+		writeJSON(w, http.StatusConflict, map[string]interface{}{
+			"error":  "this replica doesn't hold the scheduler lease",
+			"leader": holder,
+		})
+		return false
+	}
+	if isJobRunning(j.Name) {
+		audit.Result = "conflict"
+		http.Error(w, "Job is already running", http.StatusConflict)
+		return false
+	}
+
+	started := goBackground(func() {
+		if _, err := runJob(jobsCtx, j, "manual"); err != nil {
+			log.Warn("jobs: %s failed: %v", j.Name, err)
+		}
+	})
+	if !started {
+		audit.Result = "shutting_down"
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return false
+	}
+	logger.Info("admin: job %s triggered", j.Name)
+	audit.Result = "ok"
+	return true
+}
+
+func adminCleanupReportsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	reports, err := recentCleanupReports(ctx, db, 20)
+	if err != nil {
+		log.FromContext(r.Context()).Error("admin: cleanup reports lookup error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reports": reports})
+}
+
+func adminJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	list, err := listJobs(ctx, db)
+	if err != nil {
+		log.FromContext(r.Context()).Error("admin: job list error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"leader": schedulerLease.isHeld(),
+		"jobs":   list,
+	})
+}
+
+// adminRunJobHandler starts a job in the background regardless of its schedule.
+func adminRunJobHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req adminRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		logger.Warn("admin: json decode error: %v", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	j, ok := findJob(req.Job)
+	if !ok {
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+
+	audit := newAuditEvent(r, "admin_run_job", adminAuditAccount)
+	defer audit.record()
+
+	if !startManualJob(w, r, db, j, audit) {
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{"started": j.Name})
+}
+
+// adminTiersHandler lists tiers on GET and creates or replaces one on POST.
+func adminTiersHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	db := adminDB(w, r)
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	if r.Method == http.MethodPost {
+		var req adminRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.Warn("admin: json decode error: %v", err)
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if req.Tier == "" {
+			http.Error(w, "Missing tier", http.StatusBadRequest)
+			return
+		}
+		for _, v := range []*int{req.MaxDataSize, req.RetentionDays, req.SavesPerHour, req.LoadsPerHour} {
+			if v != nil && *v < 0 {
+				http.Error(w, "Limits must not be negative", http.StatusBadRequest)
+				return
+			}
+		}
+
+		audit := newAuditEvent(r, "admin_tier", adminAuditAccount)
+		audit.Detail = req.Tier
+		defer audit.record()
+
+		if err := setTier(ctx, db, req.Tier, req.MaxDataSize, req.RetentionDays, req.SavesPerHour, req.LoadsPerHour); err != nil {
+			logger.Error("admin: tier update error for %s: %v", req.Tier, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("admin: updated tier %s", req.Tier)
+		audit.Result = "ok"
+	}
+
+	tiers, err := listTiers(ctx, db)
+	if err != nil {
+		logger.Error("admin: tier list error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"tiers": tiers})
+}
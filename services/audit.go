@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// auditEvent describes one account-affecting operation. Handlers create it once the
+// account ID is known and defer record(), updating Result/Bytes as they go so that
+// every return path ends up in audit_events.
+type auditEvent struct {
+	AccountID string
+	Action    string
+	IP        string
+	UserAgent string
+	RequestID string
+	Bytes     int64
+	Result    string
+	Detail    string
+
+	r *http.Request
+}
+
+func newAuditEvent(r *http.Request, action, accountID string) *auditEvent {
+	return &auditEvent{
+		AccountID: accountID,
+		Action:    action,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		RequestID: log.RequestID(r.Context()),
+		Result:    "error",
+		r:         r,
+	}
+}
+
+func (a *auditEvent) record() {
+	db := DB
+	if db == nil || a.AccountID == "" {
+		return
+	}
+
+	// The request context may already be cancelled by the time we get here
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(a.r.Context()), 5*time.Second)
+	defer cancel()
+
+	ua := a.UserAgent
+	if len(ua) > 255 {
+		ua = ua[:255]
+	}
+	_, err := db.ExecContext(ctx, `INSERT INTO audit_events (account_id, action, ip, user_agent, request_id, bytes, result, detail) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.AccountID, a.Action, a.IP, ua, a.RequestID, a.Bytes, a.Result, a.Detail)
+	if err != nil {
+		log.FromContext(ctx).Warn("audit: failed to record %s for %s: %v", a.Action, a.AccountID, err)
+	}
+}
+
+// clientIP returns the caller's address. Forwarded headers are only trusted
+// when TRUST_PROXY_HEADERS is enabled, since they are trivially spoofable otherwise.
+func clientIP(r *http.Request) string {
+	if cfg().TrustProxyHeaders {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+		if xr := r.Header.Get("X-Real-IP"); xr != "" {
+			return strings.TrimSpace(xr)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// pruneAuditEvents removes audit rows older than AUDIT_RETENTION_DAYS and returns
+// how many were (or, with dryRun, would be) removed.
+func pruneAuditEvents(ctx context.Context, dryRun bool) (int64, error) {
+	retentionDays := cfg().AuditRetentionDays
+
+	if dryRun {
+		var n int64
+		err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_events WHERE created_at < DATE_SUB(NOW(), INTERVAL ? DAY)", retentionDays).Scan(&n)
+		return n, err
+	}
+
+	res, err := DB.ExecContext(ctx, "DELETE FROM audit_events WHERE created_at < DATE_SUB(NOW(), INTERVAL ? DAY)", retentionDays)
+	if err != nil {
+		return 0, err
+	}
+	rows, _ := res.RowsAffected()
+	if rows > 0 {
+		cleanupRowsDeleted.Add(float64(rows), "audit_events")
+		log.Info("cleanup: pruned %d audit events older than %d days", rows, retentionDays)
+	}
+	return rows, nil
+}
+
+type AuditRequest struct {
+	AccountId  string `json:"accountId"`
+	ArgonToken string `json:"argonToken"`
+	Limit      int    `json:"limit"`
+}
+
+func (a *AuditRequest) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	get := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := raw[k]; ok && v != nil {
+				switch t := v.(type) {
+				case string:
+					return t
+				case float64:
+					return fmt.Sprintf("%.0f", t)
+				default:
+					return fmt.Sprintf("%v", t)
+				}
+			}
+		}
+		return ""
+	}
+	a.AccountId = get("accountId", "account_id")
+	a.ArgonToken = get("argonToken", "argon_token")
+	if n, err := strconv.Atoi(get("limit")); err == nil {
+		a.Limit = n
+	}
+	return nil
+}
+
+type auditEntry struct {
+	Action    string `json:"action"`
+	Result    string `json:"result"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Bytes     int64  `json:"bytes"`
+	CreatedAt string `json:"createdAt"`
+}
+
+func init() {
+	http.HandleFunc("/audit", auditHandler)
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		logger.Debug("audit: invalid method %s", r.Method)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("audit: read body error: %v", err)
+		http.Error(w, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+	var req AuditRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		logger.Warn("audit: json unmarshal error: %v", err)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.AccountId == "" || req.ArgonToken == "" {
+		logger.Warn("audit: missing accountId or argonToken")
+		http.Error(w, "Missing Account ID or Argon Token", http.StatusBadRequest)
+		return
+	}
+	logger = logger.With("account_id", req.AccountId)
+
+	limit := req.Limit
+	if limit <= 0 || limit > 200 {
+		limit = 50
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	db := DB
+	if db == nil {
+		logger.Error("audit: DB not initialized")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	ok, verr := ValidateArgonToken(ctx, db, req.AccountId, req.ArgonToken)
+	if verr != nil {
+		logger.Error("audit: token validation error for %s: %v", req.AccountId, verr)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		logger.Warn("audit: token validation failed for %s", req.AccountId)
+		http.Error(w, "Invalid Argon Token", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, "SELECT action, result, ip, user_agent, bytes, created_at FROM audit_events WHERE account_id = ? ORDER BY created_at DESC, id DESC LIMIT ?", req.AccountId, limit)
+	if err != nil {
+		logger.Error("audit: lookup error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	entries := []auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var ip, ua *string
+		var createdAt time.Time
+		if err := rows.Scan(&e.Action, &e.Result, &ip, &ua, &e.Bytes, &createdAt); err != nil {
+			logger.Error("audit: scan error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if ip != nil {
+			e.IP = *ip
+		}
+		if ua != nil {
+			e.UserAgent = *ua
+		}
+		e.CreatedAt = createdAt.Format(time.RFC3339)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		logger.Error("audit: rows error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": entries,
+	})
+}
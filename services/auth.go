@@ -8,13 +8,23 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"time"
 
 	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
 )
 
+// ValidateArgonToken checks token against Argon (or the 15 minute cache) and
+// records account activity on success.
 func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string) (bool, error) {
+	ok, err := validateArgonToken(ctx, db, accountID, token)
+	if ok && err == nil {
+		touchActivity(ctx, db, accountID)
+	}
+	return ok, err
+}
+
+func validateArgonToken(ctx context.Context, db *sql.DB, accountID, token string) (bool, error) {
+	logger := log.FromContext(ctx)
 	// Check cache
 	var cachedToken sql.NullString
 	var validatedAt sql.NullTime
@@ -22,13 +32,14 @@ func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string
 	if err == nil && cachedToken.Valid && cachedToken.String == token && validatedAt.Valid {
 		// Cache valid for 15 minutes
 		if time.Since(validatedAt.Time) < 15*time.Minute {
-			log.Info("auth: using cached validation for %s", accountID)
+			logger.Info("auth: using cached validation for %s", accountID)
+			argonValidations.Inc("cached")
 			return true, nil
 		}
 	}
 
-	base := os.Getenv("ARGON_BASE_URL")
-	u, _ := url.Parse(base)
+	conf := cfg()
+	u, _ := url.Parse(conf.ArgonBaseURL)
 	q := u.Query()
 	q.Set("account_id", accountID)
 	q.Set("authtoken", token)
@@ -42,27 +53,30 @@ func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string
 	for i := 0; i < 3; i++ {
 		req, err := http.NewRequestWithContext(ctx, http.MethodGet, argonURL, nil)
 		if err != nil {
-			log.Warn("auth: failed to create argon request for %s: %v", accountID, err)
+			logger.Warn("auth: failed to create argon request for %s: %v", accountID, err)
+			argonValidations.Inc("error")
 			return false, err
 		}
 
-		if authHeader := os.Getenv("ARGON_AUTH_HEADER"); authHeader != "" {
-			req.Header.Add("Authorization", authHeader)
+		if conf.ArgonAuthHeader != "" {
+			req.Header.Add("Authorization", conf.ArgonAuthHeader)
 		}
 
 		client := &http.Client{Timeout: 10 * time.Second}
 		resp, reqErr = client.Do(req)
 		if reqErr != nil {
-			log.Warn("auth: argon request error for %s: %v", accountID, reqErr)
+			logger.Warn("auth: argon request error for %s: %v", accountID, reqErr)
+			argonValidations.Inc("error")
 			return false, reqErr
 		}
 
 		if resp.StatusCode == 429 {
 			if i < 2 {
 				resp.Body.Close()
-				log.Warn("auth: argon rate limit checking %s (attempt %d/3), waiting...", accountID, i+1)
+				logger.Warn("auth: argon rate limit checking %s (attempt %d/3), waiting...", accountID, i+1)
 				select {
 				case <-ctx.Done():
+					argonValidations.Inc("error")
 					return false, ctx.Err()
 				case <-time.After(time.Duration(1<<i) * time.Second):
 					continue
@@ -73,6 +87,7 @@ func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string
 	}
 
 	if resp == nil {
+		argonValidations.Inc("error")
 		if reqErr != nil {
 			return false, reqErr
 		}
@@ -82,15 +97,18 @@ func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Warn("auth: error reading argon response for %s: %v", accountID, err)
+		logger.Warn("auth: error reading argon response for %s: %v", accountID, err)
+		argonValidations.Inc("error")
 		return false, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		log.Warn("auth: argon validation HTTP %d for %s: %s", resp.StatusCode, accountID, string(body))
+		logger.Warn("auth: argon validation HTTP %d for %s: %s", resp.StatusCode, accountID, string(body))
 		if resp.StatusCode == 429 {
+			argonValidations.Inc("rate_limited")
 			return false, fmt.Errorf("rate limit exceeded")
 		}
+		argonValidations.Inc("invalid")
 		return false, nil // invalid token
 	}
 
@@ -99,19 +117,22 @@ func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string
 		Valid bool `json:"valid"`
 	}
 
-	log.Debug("auth: argon response for %s (status %d): %s", accountID, resp.StatusCode, string(body))
+	logger.Debug("auth: argon response for %s (status %d): %s", accountID, resp.StatusCode, string(body))
 
 	if err := json.Unmarshal(body, &out); err != nil {
-		log.Warn("auth: error parsing argon response JSON for %s: %v", accountID, err)
+		logger.Warn("auth: error parsing argon response JSON for %s: %v", accountID, err)
+		argonValidations.Inc("error")
 		return false, err
 	}
 
 	if !out.Valid {
-		log.Warn("auth: argon validation returned valid=false for %s", accountID)
+		logger.Warn("auth: argon validation returned valid=false for %s", accountID)
+		argonValidations.Inc("invalid")
 		return false, nil
 	}
 
-	log.Info("auth: argon validation successful for %s", accountID)
+	logger.Info("auth: argon validation successful for %s", accountID)
+	argonValidations.Inc("success")
 
 	var existingToken sql.NullString
 	// Re-check DB for update
@@ -119,18 +140,18 @@ func ValidateArgonToken(ctx context.Context, db *sql.DB, accountID, token string
 	err = row.Scan(&existingToken)
 
 	if err == sql.ErrNoRows {
-		log.Info("auth: creating new account row for %s", accountID)
+		logger.Info("auth: creating new account row for %s", accountID)
 		if _, cerr := db.ExecContext(ctx, "INSERT INTO accounts (account_id, argon_token, token_validated_at) VALUES (?, ?, CURRENT_TIMESTAMP)", accountID, token); cerr != nil {
-			log.Error("auth: failed to create account row for %s: %v", accountID, cerr)
+			logger.Error("auth: failed to create account row for %s: %v", accountID, cerr)
 			return false, cerr
 		}
 	} else if err != nil {
-		log.Error("auth: account lookup error for %s: %v", accountID, err)
+		logger.Error("auth: account lookup error for %s: %v", accountID, err)
 		return false, err
 	} else {
-		log.Info("auth: updating token for existing account %s", accountID)
+		logger.Info("auth: updating token for existing account %s", accountID)
 		if _, uerr := db.ExecContext(ctx, "UPDATE accounts SET argon_token = ?, token_validated_at = CURRENT_TIMESTAMP WHERE account_id = ?", token, accountID); uerr != nil {
-			log.Error("auth: failed to update token for %s: %v", accountID, uerr)
+			logger.Error("auth: failed to update token for %s: %v", accountID, uerr)
 			return false, uerr
 		}
 	}
@@ -176,49 +197,51 @@ func (a *authRequest) UnmarshalJSON(data []byte) error {
 }
 
 func authHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
 	if r.Method != http.MethodPost {
-		log.Debug("auth: invalid method %s from %s", r.Method, r.RemoteAddr)
+		logger.Debug("auth: invalid method %s from %s", r.Method, r.RemoteAddr)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Warn("auth: read body error from %s: %v", r.RemoteAddr, err)
+		logger.Warn("auth: read body error from %s: %v", r.RemoteAddr, err)
 		http.Error(w, "Failed to read request", http.StatusBadRequest)
 		return
 	}
 
 	var req authRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Warn("auth: json unmarshal error from %s: %v (body len=%d)", r.RemoteAddr, err, len(body))
+		logger.Warn("auth: json unmarshal error from %s: %v (body len=%d)", r.RemoteAddr, err, len(body))
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 	if req.AccountId == "" || req.ArgonToken == "" {
-		log.Warn("auth: missing accountId or argonToken (accountId='%s', tokenPresent=%v)", req.AccountId, req.ArgonToken != "")
+		logger.Warn("auth: missing accountId or argonToken (accountId='%s', tokenPresent=%v)", req.AccountId, req.ArgonToken != "")
 		http.Error(w, "Missing Account ID or Argon Token", http.StatusBadRequest)
 		return
 	}
+	logger = logger.With("account_id", req.AccountId)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
 	db := DB
 	if db == nil {
-		log.Error("auth: DB not initialized")
+		logger.Error("auth: DB not initialized")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	ok, verr := ValidateArgonToken(ctx, db, req.AccountId, req.ArgonToken)
 	if verr != nil {
-		log.Error("auth: token validation error for %s: %v", req.AccountId, verr)
+		logger.Error("auth: token validation error for %s: %v", req.AccountId, verr)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	if !ok {
-		log.Warn("auth: token invalid for %s", req.AccountId)
+		logger.Warn("auth: token invalid for %s", req.AccountId)
 		http.Error(w, "Invalid Argon Token", http.StatusForbidden)
 		return
 	}
@@ -7,8 +7,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
 	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
@@ -49,51 +47,49 @@ func init() {
 }
 
 func checkHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Debug("check: invalid method %s", r.Method)
+		logger.Debug("check: invalid method %s", r.Method)
 		return
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Warn("check: read body error: %v", err)
+		logger.Warn("check: read body error: %v", err)
 		http.Error(w, "Failed to read request", http.StatusBadRequest)
 		return
 	}
 	var req CheckRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Warn("check: json unmarshal error: %v", err)
+		logger.Warn("check: json unmarshal error: %v", err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 	if req.AccountId == "" || req.ArgonToken == "" {
-		log.Warn("check: missing accountId or argonToken")
+		logger.Warn("check: missing accountId or argonToken")
 		http.Error(w, "Missing Account ID or Argon Token", http.StatusBadRequest)
 		return
 	}
-
-	maxDataSize := 33554432
-	if v := os.Getenv("MAX_DATA_SIZE_BYTES"); v != "" {
-		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-			maxDataSize = parsed
-		}
-	}
+	logger = logger.With("account_id", req.AccountId)
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
 	db := DB
 	if db == nil {
-		log.Error("check: DB not initialized")
+		logger.Error("check: DB not initialized")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	var storedToken sql.NullString
 	var isSubscriber bool
+	var overQuotaSince sql.NullTime
+	// Read before this request counts as activity, so it shows the previous one
+	var lastActivity sql.NullTime
 	// Note: subscriber column usage
-	row := db.QueryRowContext(ctx, "SELECT argon_token, subscriber FROM accounts WHERE account_id = ?", req.AccountId)
-	switch err := row.Scan(&storedToken, &isSubscriber); err {
+	row := db.QueryRowContext(ctx, "SELECT argon_token, subscriber, over_quota_since, COALESCE(last_activity_at, created_at) FROM accounts WHERE account_id = ?", req.AccountId)
+	switch err := row.Scan(&storedToken, &isSubscriber, &overQuotaSince, &lastActivity); err {
 	case sql.ErrNoRows:
 		http.Error(w, "Account not found", http.StatusForbidden)
 		return
@@ -102,27 +98,24 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Invalid Argon Token", http.StatusForbidden)
 			return
 		}
+		touchActivity(ctx, db, req.AccountId)
 	default:
-		log.Error("check: account lookup error: %v", err)
+		logger.Error("check: account lookup error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Adjust maxDataSize for subscribers
-	if isSubscriber {
-		// Default 512MB
-		maxDataSize = 536870912
-		// Override from env if present
-		if v := os.Getenv("SUBSCRIBER_MAX_DATA_SIZE_BYTES"); v != "" {
-			if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-				maxDataSize = parsed
-			}
-		}
+	limits, err := accountTier(ctx, db, req.AccountId)
+	if err != nil {
+		logger.Error("check: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
+	maxDataSize := limits.MaxDataSize
 
 	var saveData, levelData sql.NullString
 	var createdAt sql.NullTime
-	r2 := db.QueryRowContext(ctx, "SELECT save_data, level_data, created_at FROM saves WHERE account_id = ?", req.AccountId)
+	r2 := db.QueryRowContext(ctx, "SELECT save_data, level_data, created_at FROM saves WHERE account_id = ? AND deleted_at IS NULL", req.AccountId)
 	if err := r2.Scan(&saveData, &levelData, &createdAt); err != nil {
 		if err == sql.ErrNoRows {
 			// not found (new account)
@@ -137,10 +130,15 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 				"freeSpacePercentage": 100.0,
 				"usedSpacePercentage": 0.0,
 				"subscriber":          isSubscriber,
+				"tier":                limits,
+				"expiresAt":           "",
+				"expiresInDays":       nil,
+				"lastActivity":        nullTimePtr(lastActivity),
+				"overQuota":           nil,
 			})
 			return
 		}
-		log.Error("check: save lookup error: %v", err)
+		logger.Error("check: save lookup error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -154,6 +152,15 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	lastSaved := ""
 	lastSavedRelative := ""
+	expiresAt := ""
+	var expiresInDays *int
+	// Accounts inactive for the retention window are removed by the cleanup;
+	// this request counts as activity, so the clock starts now
+	if expiry, ok := limits.backupExpiry(time.Now()); ok {
+		expiresAt = expiry.Format(time.RFC3339)
+		days := daysUntil(expiry)
+		expiresInDays = &days
+	}
 	if createdAt.Valid {
 		lastSaved = createdAt.Time.Format(time.RFC3339)
 		days := int(time.Since(createdAt.Time).Hours() / 24)
@@ -172,19 +179,30 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 	if freeSpace < 0 {
 		freeSpace = 0
 	}
+	// Not flagged yet if the membership lapsed since the last subscriber-expiry run
+	since := time.Now()
+	if overQuotaSince.Valid {
+		since = overQuotaSince.Time
+	}
+	quotaState := cfg().overQuotaState(totalSize, maxDataSize, since)
 	freeSpacePercentage := float64(freeSpace) / float64(maxDataSize) * 100
 	usedSpacePercentage := float64(totalSize) / float64(maxDataSize) * 100
 
 	resp := struct {
-		SaveData            int     `json:"saveData"`
-		LevelData           int     `json:"levelData"`
-		TotalSize           int     `json:"totalSize"`
-		LastSaved           string  `json:"lastSaved"`
-		LastSavedRelative   string  `json:"lastSavedRelative"`
-		FreeSpacePercentage float64 `json:"freeSpacePercentage"`
-		UsedSpacePercentage float64 `json:"usedSpacePercentage"`
-		MaxDataSize         int     `json:"maxDataSize"`
-		Subscriber          bool    `json:"subscriber"`
+		SaveData            int        `json:"saveData"`
+		LevelData           int        `json:"levelData"`
+		TotalSize           int        `json:"totalSize"`
+		LastSaved           string     `json:"lastSaved"`
+		LastSavedRelative   string     `json:"lastSavedRelative"`
+		FreeSpacePercentage float64    `json:"freeSpacePercentage"`
+		UsedSpacePercentage float64    `json:"usedSpacePercentage"`
+		MaxDataSize         int        `json:"maxDataSize"`
+		Subscriber          bool       `json:"subscriber"`
+		Tier                *tier      `json:"tier"`
+		ExpiresAt           string     `json:"expiresAt"`
+		ExpiresInDays       *int       `json:"expiresInDays"`
+		LastActivity        *time.Time `json:"lastActivity"`
+		OverQuota           *overQuota `json:"overQuota"`
 	}{
 		SaveData:            saveLen,
 		LevelData:           levelLen,
@@ -195,6 +213,11 @@ func checkHandler(w http.ResponseWriter, r *http.Request) {
 		UsedSpacePercentage: usedSpacePercentage,
 		MaxDataSize:         maxDataSize,
 		Subscriber:          isSubscriber,
+		Tier:                limits,
+		ExpiresAt:           expiresAt,
+		ExpiresInDays:       expiresInDays,
+		LastActivity:        nullTimePtr(lastActivity),
+		OverQuota:           quotaState,
 	}
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+var cleanupRunning atomic.Bool
+
+type inactiveAccount struct {
+	AccountID    string    `json:"accountId"`
+	Bytes        int64     `json:"bytes"`
+	Subscriber   bool      `json:"subscriber"`
+	Tier         string    `json:"tier"`
+	Orphan       bool      `json:"orphan"`
+	LastActivity time.Time `json:"lastActivity"`
+}
+
+// cleanupReport summarizes a cleanup run. Dry runs list the affected accounts;
+// real runs are persisted to cleanup_reports.
+type cleanupReport struct {
+	DryRun                  bool              `json:"dryRun"`
+	Phases                  []string          `json:"phases"`
+	StartedAt               time.Time         `json:"startedAt"`
+	FinishedAt              time.Time         `json:"finishedAt"`
+	RetentionDays           int               `json:"retentionDays"`
+	SubscriberRetentionDays int               `json:"subscriberRetentionDays"`
+	AccountsWarned          int               `json:"accountsWarned"`
+	AccountsRemoved         int               `json:"accountsRemoved"`
+	OrphansRemoved          int               `json:"orphansRemoved"`
+	BytesReclaimed          int64             `json:"bytesReclaimed"`
+	SubscribersExpired      int64             `json:"subscribersExpired"`
+	BackupsPurged           int64             `json:"backupsPurged"`
+	OverQuotaMarked         int64             `json:"overQuotaMarked"`
+	OverQuotaTrimmed        int64             `json:"overQuotaTrimmed"`
+	OverQuotaBytesTrimmed   int64             `json:"overQuotaBytesTrimmed"`
+	AuditEventsPruned       int64             `json:"auditEventsPruned"`
+	Accounts                []inactiveAccount `json:"accounts,omitempty"`
+	Errors                  []string          `json:"errors,omitempty"`
+}
+
+func (r *cleanupReport) addError(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	log.Error("cleanup: %s", msg)
+	r.Errors = append(r.Errors, msg)
+}
+
+// Cleanup phases. A full cleanup (admin API, command line) runs all of them in
+// this order; the scheduler runs each as its own job.
+const (
+	phaseExpiryWarnings   = "expiry-warnings"
+	phaseInactiveAccounts = "inactive-accounts"
+	phaseTrashPurge       = "trash-purge"
+	phaseSubscriberExpiry = "subscriber-expiry"
+	phaseOverQuotaTrim    = "over-quota-trim"
+	phaseAuditPrune       = "audit-prune"
+)
+
+var allCleanupPhases = []string{phaseExpiryWarnings, phaseInactiveAccounts, phaseTrashPurge, phaseSubscriberExpiry, phaseOverQuotaTrim, phaseAuditPrune}
+
+var cleanupPhases = map[string]func(ctx context.Context, conf *Config, report *cleanupReport){
+	phaseExpiryWarnings:   warnExpiringPhase,
+	phaseInactiveAccounts: trashInactivePhase,
+	phaseTrashPurge:       purgeTrashPhase,
+	phaseSubscriberExpiry: expireSubscribersPhase,
+	phaseOverQuotaTrim:    trimOverQuotaPhase,
+	phaseAuditPrune:       pruneAuditPhase,
+}
+
+// performCleanup runs the given cleanup phases, or all of them if none are
+// given: warning accounts about to expire, moving accounts inactive for the
+// retention window to the trash (including orphans that never stored a backup),
+// purging trash older than the recovery window, dropping subscriber status from
+// accounts without an active membership, trimming accounts over quota for
+// longer than the grace period and pruning old audit events. With
+// dryRun set nothing is modified and the report lists what would be removed.
+func performCleanup(ctx context.Context, dryRun bool, phases ...string) (*cleanupReport, error) {
+	if len(phases) == 0 {
+		phases = allCleanupPhases
+	}
+	conf := cfg()
+	report := &cleanupReport{
+		DryRun:                  dryRun,
+		Phases:                  phases,
+		StartedAt:               time.Now(),
+		RetentionDays:           conf.CleanupRetentionDays,
+		SubscriberRetentionDays: conf.SubscriberRetentionDays,
+	}
+
+	log.Debug("cleanup: running %s (dryRun=%v)...", strings.Join(phases, ", "), dryRun)
+	if DB == nil {
+		log.Error("cleanup: DB not initialized")
+		return nil, fmt.Errorf("DB not initialized")
+	}
+	for _, phase := range phases {
+		if cleanupPhases[phase] == nil {
+			return nil, fmt.Errorf("unknown cleanup phase %q", phase)
+		}
+	}
+	if !dryRun {
+		if !cleanupRunning.CompareAndSwap(false, true) {
+			log.Warn("cleanup: a run is already in progress, skipping")
+			return nil, fmt.Errorf("cleanup already in progress")
+		}
+		defer cleanupRunning.Store(false)
+
+		defer func() {
+			cleanupRuns.Inc()
+			cleanupDuration.Observe(time.Since(report.StartedAt).Seconds())
+		}()
+	}
+
+	for _, phase := range phases {
+		if ctx.Err() != nil {
+			report.addError("%s skipped: %v", phase, ctx.Err())
+			continue
+		}
+		cleanupPhases[phase](ctx, conf, report)
+	}
+
+	report.FinishedAt = time.Now()
+	if !dryRun {
+		saveCleanupReport(ctx, report)
+	}
+	return report, nil
+}
+
+func warnExpiringPhase(ctx context.Context, conf *Config, report *cleanupReport) {
+	warned, err := notifyExpiringAccounts(ctx, report.DryRun)
+	if err != nil {
+		report.addError("failed to warn expiring accounts: %v", err)
+	}
+	report.AccountsWarned = warned
+	if warned > 0 {
+		log.Info("cleanup: %s %d accounts about their backup expiring", verbFor(report.DryRun, "warned"), warned)
+	}
+}
+
+func trashInactivePhase(ctx context.Context, conf *Config, report *cleanupReport) {
+	if report.DryRun {
+		candidates, err := findInactiveAccounts(ctx, DB, 0)
+		if err != nil {
+			report.addError("failed to find inactive accounts: %v", err)
+		}
+		report.Accounts = candidates
+		for _, a := range candidates {
+			report.AccountsRemoved++
+			report.BytesReclaimed += a.Bytes
+			if a.Orphan {
+				report.OrphansRemoved++
+			}
+		}
+	} else {
+		for {
+			// Process them in chunks of 500 to prevent large gap locks blockading incoming `saves`
+			candidates, err := findInactiveAccounts(ctx, DB, 500)
+			if err != nil {
+				report.addError("failed to find inactive accounts: %v", err)
+				break
+			}
+
+			if len(candidates) == 0 {
+				break
+			}
+
+			args := make([]interface{}, len(candidates))
+			placeholders := make([]string, len(candidates))
+			var chunkBytes int64
+			var chunkOrphans int
+			for i, a := range candidates {
+				args[i] = a.AccountID
+				placeholders[i] = "?"
+				chunkBytes += a.Bytes
+				if a.Orphan {
+					chunkOrphans++
+				}
+			}
+			inClause := strings.Join(placeholders, ",")
+
+			// Using bulk updates reduces index tree lock congestion,
+			// but chunking limits the table-lock impact duration
+			trashSaves := fmt.Sprintf("UPDATE saves SET deleted_at = CURRENT_TIMESTAMP WHERE account_id IN (%s) AND deleted_at IS NULL", inClause)
+			_, errSaves := DB.ExecContext(ctx, trashSaves, args...)
+			if errSaves != nil {
+				log.Warn("cleanup: chunk saves trash error: %v", errSaves)
+			}
+
+			trashAccounts := fmt.Sprintf("UPDATE accounts SET deleted_at = CURRENT_TIMESTAMP WHERE account_id IN (%s)", inClause)
+			_, errAcc := DB.ExecContext(ctx, trashAccounts, args...)
+			if errAcc != nil {
+				log.Warn("cleanup: chunk accounts trash error: %v", errAcc)
+			}
+
+			if errSaves != nil || errAcc != nil {
+				// Bail out rather than selecting the same chunk forever
+				report.addError("chunk trash error: %v", errors.Join(errSaves, errAcc))
+				break
+			}
+
+			report.AccountsRemoved += len(candidates)
+			report.OrphansRemoved += chunkOrphans
+			report.BytesReclaimed += chunkBytes
+			time.Sleep(100 * time.Millisecond) // Yield the table briefly
+		}
+
+		cleanupRowsDeleted.Add(float64(report.AccountsRemoved), "inactive_accounts")
+	}
+
+	if report.AccountsRemoved > 0 {
+		log.Info("cleanup: %s %d inactive accounts to the trash (%d without a backup, %d bytes)", verbFor(report.DryRun, "moved"), report.AccountsRemoved, report.OrphansRemoved, report.BytesReclaimed)
+	} else {
+		log.Debug("cleanup: no inactive accounts found")
+	}
+}
+
+func purgeTrashPhase(ctx context.Context, conf *Config, report *cleanupReport) {
+	purged, err := purgeTrash(ctx, conf.RecoveryWindowDays, report.DryRun)
+	if err != nil {
+		report.addError("failed to purge trash: %v", err)
+	}
+	report.BackupsPurged = purged
+	if purged > 0 {
+		log.Info("cleanup: %s %d backups deleted more than %d days ago", verbFor(report.DryRun, "purged"), purged, conf.RecoveryWindowDays)
+	}
+}
+
+func expireSubscribersPhase(ctx context.Context, conf *Config, report *cleanupReport) {
+	// Cleanup expired memberships / subscribers
+	expiredPredicate := `subscriber = 1
+				 AND NOT EXISTS (
+					 SELECT 1 FROM memberships m
+					 WHERE m.account_id = a.account_id
+					 AND (m.expires_at > NOW() OR m.expires_at IS NULL)
+				 )`
+	if report.DryRun {
+		if err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts a WHERE "+expiredPredicate).Scan(&report.SubscribersExpired); err != nil {
+			report.addError("failed to count expired subscribers: %v", err)
+		}
+	} else if resSub, err := DB.ExecContext(ctx, "UPDATE accounts a SET subscriber = 0 WHERE "+expiredPredicate); err != nil {
+		report.addError("failed to update expired subscribers: %v", err)
+	} else {
+		report.SubscribersExpired, _ = resSub.RowsAffected()
+		cleanupRowsDeleted.Add(float64(report.SubscribersExpired), "expired_subscribers")
+	}
+	if report.SubscribersExpired > 0 {
+		log.Info("cleanup: %s subscriber status from %d expired accounts", verbFor(report.DryRun, "removed"), report.SubscribersExpired)
+	}
+
+	// Lapsed memberships leave accounts with less storage; flag the ones now over it
+	marked, err := markOverQuota(ctx, DB, report.DryRun)
+	if err != nil {
+		report.addError("failed to flag over-quota accounts: %v", err)
+	}
+	report.OverQuotaMarked = marked
+	if marked > 0 {
+		log.Info("cleanup: %s %d accounts as over quota", verbFor(report.DryRun, "flagged"), marked)
+	}
+}
+
+func pruneAuditPhase(ctx context.Context, conf *Config, report *cleanupReport) {
+	pruned, err := pruneAuditEvents(ctx, report.DryRun)
+	if err != nil {
+		report.addError("failed to prune audit events: %v", err)
+	}
+	report.AuditEventsPruned = pruned
+}
+
+// summary describes the outcome of the phases that ran in one line.
+func (r *cleanupReport) summary() string {
+	var parts []string
+	for _, phase := range r.Phases {
+		switch phase {
+		case phaseExpiryWarnings:
+			parts = append(parts, fmt.Sprintf("%d accounts warned", r.AccountsWarned))
+		case phaseInactiveAccounts:
+			parts = append(parts, fmt.Sprintf("%d accounts trashed (%d orphans, %d bytes)", r.AccountsRemoved, r.OrphansRemoved, r.BytesReclaimed))
+		case phaseTrashPurge:
+			parts = append(parts, fmt.Sprintf("%d backups purged", r.BackupsPurged))
+		case phaseSubscriberExpiry:
+			parts = append(parts, fmt.Sprintf("%d subscribers expired, %d accounts over quota", r.SubscribersExpired, r.OverQuotaMarked))
+		case phaseOverQuotaTrim:
+			parts = append(parts, fmt.Sprintf("%d over-quota accounts trimmed (%d bytes)", r.OverQuotaTrimmed, r.OverQuotaBytesTrimmed))
+		case phaseAuditPrune:
+			parts = append(parts, fmt.Sprintf("%d audit events pruned", r.AuditEventsPruned))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func verbFor(dryRun bool, verb string) string {
+	if dryRun {
+		return "would have " + verb
+	}
+	return verb
+}
+
+// findInactiveAccounts returns accounts whose last activity is older than the
+// retention of their tier (0 keeps them forever). Accounts without a live
+// backup are returned as orphans. A limit of 0 returns all of them.
+func findInactiveAccounts(ctx context.Context, db *sql.DB, limit int) ([]inactiveAccount, error) {
+	conf := cfg()
+	selectQuery := `SELECT x.account_id, x.bytes, x.tier_name, x.orphan, x.last_activity
+					FROM (
+						SELECT a.account_id,
+							CASE WHEN s.deleted_at IS NULL THEN LENGTH(s.save_data) + LENGTH(s.level_data) END AS bytes,
+							s.account_id IS NULL OR s.deleted_at IS NOT NULL AS orphan,
+							COALESCE(a.last_activity_at, a.created_at) AS last_activity,
+							` + accountTierNameSQL + ` AS tier_name
+						FROM accounts a
+						LEFT JOIN saves s ON a.account_id = s.account_id
+						WHERE a.deleted_at IS NULL
+					) x
+					LEFT JOIN tiers t ON t.name = x.tier_name
+					WHERE ` + tierRetentionSQL + ` > 0
+					  AND x.last_activity < DATE_SUB(NOW(), INTERVAL ` + tierRetentionSQL + ` DAY)`
+	if limit > 0 {
+		selectQuery += fmt.Sprintf(" LIMIT %d", limit)
+	}
+
+	rows, err := db.QueryContext(ctx, selectQuery, append(conf.tierRetentionArgs(), conf.tierRetentionArgs()...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []inactiveAccount
+	for rows.Next() {
+		var a inactiveAccount
+		var bytes sql.NullInt64
+		if err := rows.Scan(&a.AccountID, &bytes, &a.Tier, &a.Orphan, &a.LastActivity); err != nil {
+			return nil, err
+		}
+		a.Bytes = bytes.Int64
+		a.Subscriber = a.Tier != freeTierName
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// purgeTrash permanently removes backups that were deleted more than
+// recoveryDays ago, along with accounts the cleanup moved to the trash. It
+// returns the number of backups purged (or, with dryRun, that would be).
+func purgeTrash(ctx context.Context, recoveryDays int, dryRun bool) (int64, error) {
+	if dryRun {
+		var n int64
+		err := DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM saves WHERE deleted_at < DATE_SUB(NOW(), INTERVAL ? DAY)", recoveryDays).Scan(&n)
+		return n, err
+	}
+
+	var total int64
+	for {
+		// Same chunking as above to keep lock time short
+		res, err := DB.ExecContext(ctx, "DELETE FROM saves WHERE deleted_at < DATE_SUB(NOW(), INTERVAL ? DAY) LIMIT 500", recoveryDays)
+		if err != nil {
+			return total, err
+		}
+		n, _ := res.RowsAffected()
+		total += n
+		if n < 500 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	cleanupRowsDeleted.Add(float64(total), "purged_backups")
+
+	_, err := DB.ExecContext(ctx, `DELETE FROM accounts
+		WHERE deleted_at < DATE_SUB(NOW(), INTERVAL ? DAY)
+		AND NOT EXISTS (SELECT 1 FROM saves s WHERE s.account_id = accounts.account_id)`, recoveryDays)
+	return total, err
+}
+
+func saveCleanupReport(ctx context.Context, report *cleanupReport) {
+	// Persist even if the run itself hit its deadline
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+
+	_, err := DB.ExecContext(ctx, `INSERT INTO cleanup_reports (phases, started_at, finished_at, retention_days, subscriber_retention_days, accounts_warned, accounts_removed, orphans_removed, bytes_reclaimed, subscribers_expired, backups_purged, over_quota_marked, over_quota_trimmed, over_quota_bytes_trimmed, audit_events_pruned, errors) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		strings.Join(report.Phases, ","), report.StartedAt, report.FinishedAt, report.RetentionDays, report.SubscriberRetentionDays, report.AccountsWarned, report.AccountsRemoved, report.OrphansRemoved, report.BytesReclaimed, report.SubscribersExpired, report.BackupsPurged, report.OverQuotaMarked, report.OverQuotaTrimmed, report.OverQuotaBytesTrimmed, report.AuditEventsPruned, strings.Join(report.Errors, "\n"))
+	if err != nil {
+		log.Warn("cleanup: failed to persist report: %v", err)
+	}
+}
+
+// recentCleanupReports returns the latest persisted reports, newest first.
+func recentCleanupReports(ctx context.Context, db *sql.DB, limit int) ([]cleanupReport, error) {
+	rows, err := db.QueryContext(ctx, `SELECT phases, started_at, finished_at, retention_days, subscriber_retention_days, accounts_warned, accounts_removed, orphans_removed, bytes_reclaimed, subscribers_expired, backups_purged, over_quota_marked, over_quota_trimmed, over_quota_bytes_trimmed, audit_events_pruned, errors FROM cleanup_reports ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := []cleanupReport{}
+	for rows.Next() {
+		var r cleanupReport
+		var phases, errs sql.NullString
+		if err := rows.Scan(&phases, &r.StartedAt, &r.FinishedAt, &r.RetentionDays, &r.SubscriberRetentionDays, &r.AccountsWarned, &r.AccountsRemoved, &r.OrphansRemoved, &r.BytesReclaimed, &r.SubscribersExpired, &r.BackupsPurged, &r.OverQuotaMarked, &r.OverQuotaTrimmed, &r.OverQuotaBytesTrimmed, &r.AuditEventsPruned, &errs); err != nil {
+			return nil, err
+		}
+		if phases.String != "" {
+			r.Phases = strings.Split(phases.String, ",")
+		}
+		if errs.String != "" {
+			r.Errors = strings.Split(errs.String, "\n")
+		}
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
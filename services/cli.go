@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Operator subcommands. They share the server's config and DB code:
+//
+//	gdaltweb [config flags] serve
+//	gdaltweb [config flags] migrate up|down [n]|status
+//	gdaltweb [config flags] account show|delete|export|import <accountId>
+//	gdaltweb [config flags] membership list|grant|revoke|refund|transfer
+//	gdaltweb [config flags] tier list|set
+//	gdaltweb [config flags] cleanup [-dry-run]
+//	gdaltweb [config flags] stats
+
+const cliUsage = `usage: gdaltweb [config flags] <command> [args]
+
+commands:
+  serve                                   run the HTTP server (default)
+  migrate up|down [n]|status              manage schema migrations
+  account show <accountId>                print account details
+  account delete -yes <accountId>         move an account's backup to the trash
+  account export [-o file] <accountId>    write an account's backup as JSON
+  account import [-i file] <accountId>    restore a backup exported with "account export"
+  membership list [-account id] [-active] list memberships
+  membership grant -days n [-email e] [-tier name] <accountId>
+                                          grant or extend a membership
+  membership revoke [-days n] <accountId> end an account's memberships now, or
+                                          shorten them by n days
+  membership transfer [-to id] [-email e] <accountId>
+                                          move an account's memberships to
+                                          another account, or unlink them
+                                          without -to; ignores the cooldown
+  membership refund [-provider p] <transactionId>
+                                          stop a payment counting towards its
+                                          membership (provider defaults to kofi)
+  tier list                               list tiers and their effective limits
+  tier set [-max-data-size n] [-retention-days n] [-saves-per-hour n]
+           [-loads-per-hour n] <name>
+                                          create or replace a tier; omitted
+                                          limits use the config defaults
+  cleanup [-dry-run]                      run inactive-account cleanup
+  stats                                   print instance statistics
+`
+
+func runCommand(command string, args []string) int {
+	switch command {
+	case "help", "-h", "--help":
+		fmt.Print(cliUsage)
+		return 0
+	case "migrate", "account", "membership", "tier", "cleanup", "stats":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, cliUsage)
+		return 2
+	}
+
+	if err := initGlobalDB(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: DB init failed: %v\n", command, err)
+		return 1
+	}
+	defer DB.Close()
+
+	var err error
+	switch command {
+	case "migrate":
+		return runMigrateCommand(args)
+	case "account":
+		err = runAccountCommand(args)
+	case "membership":
+		err = runMembershipCommand(args)
+	case "tier":
+		err = runTierCommand(args)
+	case "cleanup":
+		err = runCleanupCommand(args)
+	case "stats":
+		err = runStatsCommand(args)
+	}
+
+	var usage usageError
+	if errors.As(err, &usage) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n\n%s", command, err, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+		return 1
+	}
+	return 0
+}
+
+type usageError string
+
+func (u usageError) Error() string { return string(u) }
+
+func cliContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Minute)
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseSubcommand parses flags for a subcommand and requires exactly one
+// positional account ID.
+func parseSubcommand(fs *flag.FlagSet, args []string) (string, error) {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return "", usageError(err.Error())
+	}
+	if fs.NArg() != 1 {
+		return "", usageError(fs.Name() + ": expected exactly one account ID")
+	}
+	return fs.Arg(0), nil
+}
+
+func runAccountCommand(args []string) error {
+	if len(args) == 0 {
+		return usageError("missing account subcommand")
+	}
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	switch args[0] {
+	case "show":
+		accountID, err := parseSubcommand(flag.NewFlagSet("account show", flag.ContinueOnError), args[1:])
+		if err != nil {
+			return err
+		}
+		info, err := lookupAccount(ctx, DB, accountID)
+		if err != nil {
+			return err
+		}
+		return printJSON(os.Stdout, info)
+
+	case "delete":
+		fs := flag.NewFlagSet("account delete", flag.ContinueOnError)
+		yes := fs.Bool("yes", false, "confirm deletion")
+		accountID, err := parseSubcommand(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if !*yes {
+			return usageError("refusing to delete without -yes")
+		}
+		existed, err := deleteBackup(ctx, DB, accountID)
+		if err != nil {
+			return err
+		}
+		if !existed {
+			return fmt.Errorf("no backup stored for %s", accountID)
+		}
+		fmt.Printf("moved backup for %s to the trash\n", accountID)
+		return nil
+
+	case "export":
+		fs := flag.NewFlagSet("account export", flag.ContinueOnError)
+		outPath := fs.String("o", "", "output file (default stdout)")
+		accountID, err := parseSubcommand(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		backup, err := exportBackup(ctx, DB, accountID)
+		if err != nil {
+			return err
+		}
+		var w io.Writer = os.Stdout
+		if *outPath != "" {
+			f, err := os.OpenFile(*outPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return printJSON(w, backup)
+
+	case "import":
+		fs := flag.NewFlagSet("account import", flag.ContinueOnError)
+		inPath := fs.String("i", "", "input file (default stdin)")
+		accountID, err := parseSubcommand(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		var r io.Reader = os.Stdin
+		if *inPath != "" {
+			f, err := os.Open(*inPath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		var backup backupExport
+		if err := json.NewDecoder(r).Decode(&backup); err != nil {
+			return fmt.Errorf("invalid backup JSON: %w", err)
+		}
+		if backup.SaveData == "" && backup.LevelData == "" {
+			return fmt.Errorf("backup contains no data")
+		}
+		if err := ensureAccount(ctx, DB, accountID); err != nil {
+			return err
+		}
+		if err := restoreBackup(ctx, DB, accountID, backup.SaveData, backup.LevelData); err != nil {
+			return err
+		}
+		fmt.Printf("imported %d bytes for %s\n", len(backup.SaveData)+len(backup.LevelData), accountID)
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown account subcommand %q", args[0]))
+}
+
+func runMembershipCommand(args []string) error {
+	if len(args) == 0 {
+		return usageError("missing membership subcommand")
+	}
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("membership list", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		accountID := fs.String("account", "", "only memberships linked to this account")
+		active := fs.Bool("active", false, "only unexpired memberships")
+		if err := fs.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		entries, err := listMemberships(ctx, DB, *accountID, *active)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tACCOUNT\tEMAIL\tTIER\tEXPIRES")
+		for _, m := range entries {
+			expires := "never"
+			if m.ExpiresAt != nil {
+				expires = m.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", m.ID, m.AccountID, m.Email, m.TierName, expires)
+		}
+		return tw.Flush()
+
+	case "grant":
+		fs := flag.NewFlagSet("membership grant", flag.ContinueOnError)
+		days := fs.Int("days", 0, "days to grant")
+		email := fs.String("email", "", "email for a new membership")
+		tier := fs.String("tier", "", "tier name for a new membership")
+		accountID, err := parseSubcommand(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if *days <= 0 {
+			return usageError("-days must be positive")
+		}
+		expiry, err := grantMembership(ctx, DB, accountID, *email, *tier, *days)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("membership for %s now expires %s\n", accountID, expiry.Format(time.RFC3339))
+		return nil
+
+	case "revoke":
+		fs := flag.NewFlagSet("membership revoke", flag.ContinueOnError)
+		days := fs.Int("days", 0, "days to take off instead of ending the memberships")
+		accountID, err := parseSubcommand(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if *days < 0 {
+			return usageError("-days must not be negative")
+		}
+		n, err := revokeMembership(ctx, DB, accountID, *days)
+		if err != nil {
+			return err
+		}
+		if *days > 0 {
+			fmt.Printf("shortened %d membership(s) for %s by %d days\n", n, accountID, *days)
+		} else {
+			fmt.Printf("ended %d membership(s) for %s\n", n, accountID)
+		}
+		return nil
+
+	case "transfer":
+		fs := flag.NewFlagSet("membership transfer", flag.ContinueOnError)
+		to := fs.String("to", "", "account to move the memberships to (unlink when empty)")
+		email := fs.String("email", "", "only memberships with this email")
+		accountID, err := parseSubcommand(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if *to == accountID {
+			return usageError("-to must be a different account")
+		}
+		n, err := moveMemberships(ctx, DB, accountID, *to, *email, true)
+		if err != nil {
+			return err
+		}
+		if *to == "" {
+			fmt.Printf("unlinked %d membership(s) from %s\n", n, accountID)
+		} else {
+			fmt.Printf("moved %d membership(s) from %s to %s\n", n, accountID, *to)
+		}
+		return nil
+
+	case "refund":
+		fs := flag.NewFlagSet("membership refund", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		provider := fs.String("provider", "kofi", "payment provider of the transaction")
+		if err := fs.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if fs.NArg() != 1 {
+			return usageError("membership refund: expected exactly one transaction ID")
+		}
+		accountID, err := refundPayment(ctx, DB, *provider, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		if accountID == "" {
+			accountID = "no linked account"
+		}
+		fmt.Printf("refunded %s:%s (%s)\n", *provider, fs.Arg(0), accountID)
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown membership subcommand %q", args[0]))
+}
+
+func runTierCommand(args []string) error {
+	if len(args) == 0 {
+		return usageError("missing tier subcommand")
+	}
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	switch args[0] {
+	case "list":
+		if len(args) > 1 {
+			return usageError("tier list takes no arguments")
+		}
+		tiers, err := listTiers(ctx, DB)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tMAX DATA SIZE\tRETENTION DAYS\tSAVES/H\tLOADS/H")
+		for _, t := range tiers {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\n", t.Name, t.MaxDataSize, t.RetentionDays, t.SavesPerHour, t.LoadsPerHour)
+		}
+		return tw.Flush()
+
+	case "set":
+		fs := flag.NewFlagSet("tier set", flag.ContinueOnError)
+		limits := map[string]*int{}
+		for _, name := range []string{"max-data-size", "retention-days", "saves-per-hour", "loads-per-hour"} {
+			name := name
+			fs.Func(name, name+" limit", func(s string) error {
+				n, err := strconv.Atoi(s)
+				if err != nil || n < 0 {
+					return fmt.Errorf("must be a non-negative integer")
+				}
+				limits[name] = &n
+				return nil
+			})
+		}
+		fs.SetOutput(io.Discard)
+		if err := fs.Parse(args[1:]); err != nil {
+			return usageError(err.Error())
+		}
+		if fs.NArg() != 1 {
+			return usageError("tier set: expected exactly one tier name")
+		}
+		name := fs.Arg(0)
+		if err := setTier(ctx, DB, name, limits["max-data-size"], limits["retention-days"], limits["saves-per-hour"], limits["loads-per-hour"]); err != nil {
+			return err
+		}
+		fmt.Printf("updated tier %s\n", name)
+		return nil
+	}
+	return usageError(fmt.Sprintf("unknown tier subcommand %q", args[0]))
+}
+
+func runCleanupCommand(args []string) error {
+	fs := flag.NewFlagSet("cleanup", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dryRun := fs.Bool("dry-run", false, "report what would be removed without deleting")
+	if err := fs.Parse(args); err != nil {
+		return usageError(err.Error())
+	}
+	ctx, cancel := cliContext()
+	defer cancel()
+
+	report, err := performCleanup(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+	if err := printJSON(os.Stdout, report); err != nil {
+		return err
+	}
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("cleanup finished with %d error(s)", len(report.Errors))
+	}
+	return nil
+}
+
+func runStatsCommand(args []string) error {
+	if len(args) > 0 {
+		return usageError("stats takes no arguments")
+	}
+	ctx, cancel := cliContext()
+	defer cancel()
+	st, err := collectStats(ctx, DB)
+	if err != nil {
+		return err
+	}
+	return printJSON(os.Stdout, st)
+}
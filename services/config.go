@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Config holds every setting the server reads. Values are resolved in order:
+// defaults, config file (CONFIG_FILE or -config, JSON), environment, flags.
+// Each field's env tag names its environment variable; the flag and config file
+// key are derived from it (MAX_DATA_SIZE_BYTES -> -max-data-size-bytes /
+// "max_data_size_bytes").
+//
+// Fields tagged reload:"restart" are only read at startup; a reload keeps their
+// old value and reports them as requiring a restart.
+type Config struct {
+	Port               int    `env:"PORT" reload:"restart" help:"HTTP listen port"`
+	AuthorizationToken string `env:"AUTHORIZATION_TOKEN" secret:"true" help:"token clients must send in the Authorization header"`
+	AdminToken         string `env:"ADMIN_TOKEN" secret:"true" help:"bearer token for the /admin API (disabled when empty)"`
+	MetricsToken       string `env:"METRICS_TOKEN" secret:"true" help:"bearer token for /metrics (defaults to ADMIN_TOKEN; disabled when both are empty)"`
+
+	DBUser             string `env:"DB_USER" reload:"restart" help:"database user"`
+	DBPass             string `env:"DB_PASS" reload:"restart" secret:"true" help:"database password"`
+	DBHost             string `env:"DB_HOST" reload:"restart" help:"database host"`
+	DBPort             int    `env:"DB_PORT" reload:"restart" help:"database port"`
+	DBName             string `env:"DB_NAME" reload:"restart" help:"database name"`
+	DBMaxAllowedPacket int    `env:"DB_MAX_ALLOWED_PACKET" reload:"restart" help:"max_allowed_packet used by the driver and for upload validation"`
+	AutoMigrate        bool   `env:"AUTO_MIGRATE" reload:"restart" help:"apply pending migrations on startup"`
+
+	InstanceID        string        `env:"INSTANCE_ID" reload:"restart" help:"name of this replica in the scheduler lease (default hostname-pid)"`
+	SchedulerLeaseTTL time.Duration `env:"SCHEDULER_LEASE_TTL" reload:"restart" help:"how long the scheduler lease lasts without renewal"`
+
+	ArgonBaseURL    string `env:"ARGON_BASE_URL" help:"Argon token validation URL"`
+	ArgonAuthHeader string `env:"ARGON_AUTH_HEADER" secret:"true" help:"Authorization header sent to Argon"`
+
+	MaxDataSizeBytes           int `env:"MAX_DATA_SIZE_BYTES" help:"storage quota for free accounts"`
+	SubscriberMaxDataSizeBytes int `env:"SUBSCRIBER_MAX_DATA_SIZE_BYTES" help:"storage quota for subscribers"`
+
+	VerificationToken    string `env:"VERIFICATION_TOKEN" secret:"true" help:"Ko-fi webhook verification token"`
+	PaymentWebhookSecret string `env:"PAYMENT_WEBHOOK_SECRET" secret:"true" help:"HMAC-SHA256 secret for signed payments at /payment/webhook (disabled when empty)"`
+
+	TransferCooldownDays int `env:"MEMBERSHIP_TRANSFER_COOLDOWN_DAYS" help:"days before a membership that changed account can be unlinked or transferred again (0 = no cooldown)"`
+
+	VerificationNotifier string        `env:"VERIFICATION_NOTIFIER" help:"how membership verification codes are sent: smtp, log or off (linking disabled)"`
+	VerificationCodeTTL  time.Duration `env:"VERIFICATION_CODE_TTL" help:"how long a membership verification code is valid"`
+	SMTPHost             string        `env:"SMTP_HOST" help:"SMTP server for verification emails"`
+	SMTPPort             int           `env:"SMTP_PORT" help:"SMTP server port"`
+	SMTPUsername         string        `env:"SMTP_USERNAME" help:"SMTP user (no authentication when empty)"`
+	SMTPPassword         string        `env:"SMTP_PASSWORD" secret:"true" help:"SMTP password"`
+	SMTPFrom             string        `env:"SMTP_FROM" help:"sender address of verification emails"`
+
+	CleanupRetentionDays    int `env:"CLEANUP_RETENTION_DAYS" help:"days without activity before a free account is removed"`
+	SubscriberRetentionDays int `env:"SUBSCRIBER_RETENTION_DAYS" help:"days without activity before a subscriber is removed (0 = never)"`
+	RecoveryWindowDays      int `env:"RECOVERY_WINDOW_DAYS" help:"days a deleted backup can be restored before it is purged"`
+	OverQuotaGraceDays      int `env:"OVER_QUOTA_GRACE_DAYS" help:"days an account may stay over its storage quota before its backup is trimmed"`
+
+	ExpiryWarningDays int    `env:"EXPIRY_WARNING_DAYS" help:"warn this many days before an inactive backup is removed (0 = off)"`
+	ExpiryWebhookURL  string `env:"EXPIRY_WEBHOOK_URL" secret:"true" help:"URL that receives expiry warnings, e.g. a Discord webhook"`
+
+	ExpiryWarningsSchedule   string `env:"EXPIRY_WARNINGS_SCHEDULE" help:"cron schedule of the expiry-warnings job (off to disable)"`
+	InactiveAccountsSchedule string `env:"INACTIVE_ACCOUNTS_SCHEDULE" help:"cron schedule of the inactive-accounts job (off to disable)"`
+	TrashPurgeSchedule       string `env:"TRASH_PURGE_SCHEDULE" help:"cron schedule of the trash-purge job (off to disable)"`
+	SubscriberExpirySchedule string `env:"SUBSCRIBER_EXPIRY_SCHEDULE" help:"cron schedule of the subscriber-expiry job (off to disable)"`
+	OverQuotaTrimSchedule    string `env:"OVER_QUOTA_TRIM_SCHEDULE" help:"cron schedule of the over-quota-trim job (off to disable)"`
+	AuditPruneSchedule       string `env:"AUDIT_PRUNE_SCHEDULE" help:"cron schedule of the audit-prune job (off to disable)"`
+
+	AuditRetentionDays int           `env:"AUDIT_RETENTION_DAYS" help:"days to keep audit events"`
+	TrustProxyHeaders  bool          `env:"TRUST_PROXY_HEADERS" help:"take the client IP from X-Forwarded-For/X-Real-IP"`
+	ShutdownTimeout    time.Duration `env:"SHUTDOWN_TIMEOUT" help:"how long to drain requests on shutdown"`
+
+	LogLevel  string `env:"LOG_LEVEL" help:"0-5 or debug/info/warn/error"`
+	LogFormat string `env:"LOG_FORMAT" help:"text, json or logfmt"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                       3001,
+		DBPort:                     3306,
+		DBMaxAllowedPacket:         1073741824,
+		AutoMigrate:                true,
+		SchedulerLeaseTTL:          time.Minute,
+		ArgonBaseURL:               "https://argon.globed.dev/v1/validation/check",
+		MaxDataSizeBytes:           33554432,
+		SubscriberMaxDataSizeBytes: 134217728,
+		CleanupRetentionDays:       60,
+		RecoveryWindowDays:         30,
+		OverQuotaGraceDays:         30,
+		VerificationNotifier:       notifierSMTP,
+		VerificationCodeTTL:        15 * time.Minute,
+		TransferCooldownDays:       30,
+		SMTPPort:                   587,
+		ExpiryWarningDays:          7,
+		ExpiryWarningsSchedule:     "0 2 * * *",
+		InactiveAccountsSchedule:   "0 3 * * *",
+		TrashPurgeSchedule:         "0 4 * * *",
+		SubscriberExpirySchedule:   "@hourly",
+		OverQuotaTrimSchedule:      "30 4 * * *",
+		AuditPruneSchedule:         "0 5 * * *",
+		AuditRetentionDays:         90,
+		ShutdownTimeout:            2 * time.Minute,
+		LogLevel:                   "0",
+		LogFormat:                  "text",
+	}
+}
+
+var currentConfig atomic.Pointer[Config]
+
+// cfg returns the active configuration. Handlers should call it once per request
+// and use the returned snapshot throughout.
+func cfg() *Config {
+	if c := currentConfig.Load(); c != nil {
+		return c
+	}
+	return defaultConfig()
+}
+
+func setConfig(c *Config) {
+	currentConfig.Store(c)
+	if lvl, ok := log.ParseLevel(c.LogLevel); ok {
+		log.SetLevel(lvl)
+	}
+	log.SetFormat(c.LogFormat)
+}
+
+type configField struct {
+	Env     string
+	Secret  bool
+	Restart bool
+	Help    string
+	value   reflect.Value
+}
+
+func (c *Config) fields() []configField {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	out := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		out = append(out, configField{
+			Env:     f.Tag.Get("env"),
+			Secret:  f.Tag.Get("secret") == "true",
+			Restart: f.Tag.Get("reload") == "restart",
+			Help:    f.Tag.Get("help"),
+			value:   v.Field(i),
+		})
+	}
+	return out
+}
+
+func (f configField) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(f.Env), "_", "-")
+}
+
+func (f configField) fileKey() string {
+	return strings.ToLower(f.Env)
+}
+
+func (f configField) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch f.value.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+		return nil
+	}
+	switch f.value.Kind() {
+	case reflect.String:
+		f.value.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("not an integer")
+		}
+		f.value.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("not a boolean")
+		}
+		f.value.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported type %s", f.value.Type())
+	}
+	return nil
+}
+
+func (f configField) String() string {
+	if d, ok := f.value.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return fmt.Sprint(f.value.Interface())
+}
+
+// flagValue adapts a configField to flag.Value.
+type flagValue struct{ f configField }
+
+func (v flagValue) String() string {
+	if !v.f.value.IsValid() {
+		return ""
+	}
+	return v.f.String()
+}
+func (v flagValue) Set(s string) error { return v.f.set(s) }
+func (v flagValue) IsBoolFlag() bool   { return v.f.value.IsValid() && v.f.value.Kind() == reflect.Bool }
+
+// loadConfig builds a Config from defaults, the optional config file, the
+// environment and command line flags, and returns the remaining positional args.
+func loadConfig(args []string) (*Config, []string, error) {
+	c := defaultConfig()
+
+	fs := flag.NewFlagSet("gdaltweb", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a JSON config file")
+	for _, f := range c.fields() {
+		fs.Var(flagValue{f}, f.flagName(), f.Help+" ("+f.Env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	// Flags were applied to c during Parse; re-apply them last so they win over
+	// the file and environment.
+	explicit := map[string]string{}
+	fs.Visit(func(fl *flag.Flag) {
+		if fl.Name != "config" {
+			explicit[fl.Name] = fl.Value.String()
+		}
+	})
+
+	c = defaultConfig()
+	if *configFile != "" {
+		if err := c.applyFile(*configFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := c.applyEnv(); err != nil {
+		return nil, nil, err
+	}
+	for _, f := range c.fields() {
+		if v, ok := explicit[f.flagName()]; ok {
+			if err := f.set(v); err != nil {
+				return nil, nil, fmt.Errorf("-%s: %v", f.flagName(), err)
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, nil, err
+	}
+	return c, fs.Args(), nil
+}
+
+func (c *Config) applyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	byKey := map[string]configField{}
+	for _, f := range c.fields() {
+		byKey[f.fileKey()] = f
+	}
+	for k, v := range raw {
+		f, ok := byKey[strings.ToLower(k)]
+		if !ok {
+			return fmt.Errorf("config file %s: unknown key %q", path, k)
+		}
+		var s string
+		switch t := v.(type) {
+		case float64:
+			s = strconv.FormatFloat(t, 'f', -1, 64)
+		default:
+			s = fmt.Sprint(t)
+		}
+		if err := f.set(s); err != nil {
+			return fmt.Errorf("config file %s: %s: %v", path, k, err)
+		}
+	}
+	return nil
+}
+
+func (c *Config) applyEnv() error {
+	for _, f := range c.fields() {
+		if v, ok := os.LookupEnv(f.Env); ok && v != "" {
+			if err := f.set(v); err != nil {
+				return fmt.Errorf("%s=%q: %v", f.Env, v, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, a ...any) { errs = append(errs, fmt.Errorf(format, a...)) }
+
+	if c.Port < 1 || c.Port > 65535 {
+		add("PORT must be between 1 and 65535 (got %d)", c.Port)
+	}
+	if c.DBUser == "" || c.DBHost == "" || c.DBName == "" {
+		add("DB_USER, DB_HOST and DB_NAME are required")
+	}
+	if c.DBPort < 1 || c.DBPort > 65535 {
+		add("DB_PORT must be between 1 and 65535 (got %d)", c.DBPort)
+	}
+	if c.DBMaxAllowedPacket <= 0 {
+		add("DB_MAX_ALLOWED_PACKET must be positive")
+	}
+	if u, err := url.Parse(c.ArgonBaseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		add("ARGON_BASE_URL must be an absolute http(s) URL (got %q)", c.ArgonBaseURL)
+	}
+	if c.MaxDataSizeBytes <= 0 {
+		add("MAX_DATA_SIZE_BYTES must be positive")
+	}
+	if c.SubscriberMaxDataSizeBytes < c.MaxDataSizeBytes {
+		add("SUBSCRIBER_MAX_DATA_SIZE_BYTES (%d) must not be smaller than MAX_DATA_SIZE_BYTES (%d)", c.SubscriberMaxDataSizeBytes, c.MaxDataSizeBytes)
+	}
+	if c.CleanupRetentionDays <= 0 {
+		add("CLEANUP_RETENTION_DAYS must be positive")
+	}
+	if c.SubscriberRetentionDays < 0 {
+		add("SUBSCRIBER_RETENTION_DAYS must not be negative")
+	} else if c.SubscriberRetentionDays > 0 && c.SubscriberRetentionDays < c.CleanupRetentionDays {
+		add("SUBSCRIBER_RETENTION_DAYS (%d) must be 0 or at least CLEANUP_RETENTION_DAYS (%d)", c.SubscriberRetentionDays, c.CleanupRetentionDays)
+	}
+	if c.RecoveryWindowDays <= 0 {
+		add("RECOVERY_WINDOW_DAYS must be positive")
+	}
+	switch c.VerificationNotifier {
+	case notifierLog, notifierOff:
+	case notifierSMTP:
+		if c.SMTPHost == "" || c.SMTPFrom == "" {
+			add("VERIFICATION_NOTIFIER=smtp requires SMTP_HOST and SMTP_FROM (set VERIFICATION_NOTIFIER=off to disable membership linking)")
+		}
+		if c.SMTPPort < 1 || c.SMTPPort > 65535 {
+			add("SMTP_PORT must be between 1 and 65535 (got %d)", c.SMTPPort)
+		}
+	default:
+		add("VERIFICATION_NOTIFIER must be smtp, log or off (got %q)", c.VerificationNotifier)
+	}
+	if c.TransferCooldownDays < 0 {
+		add("MEMBERSHIP_TRANSFER_COOLDOWN_DAYS must not be negative")
+	}
+	if c.VerificationCodeTTL < time.Minute {
+		add("VERIFICATION_CODE_TTL must be at least 1m (got %s)", c.VerificationCodeTTL)
+	}
+	if c.OverQuotaGraceDays <= 0 {
+		add("OVER_QUOTA_GRACE_DAYS must be positive")
+	}
+	if c.ExpiryWarningDays < 0 || c.ExpiryWarningDays >= c.CleanupRetentionDays {
+		add("EXPIRY_WARNING_DAYS must be between 0 and CLEANUP_RETENTION_DAYS-1 (got %d)", c.ExpiryWarningDays)
+	}
+	if c.ExpiryWebhookURL != "" {
+		if u, err := url.Parse(c.ExpiryWebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			add("EXPIRY_WEBHOOK_URL must be an absolute http(s) URL")
+		}
+	}
+	for _, s := range []struct{ env, spec string }{
+		{"EXPIRY_WARNINGS_SCHEDULE", c.ExpiryWarningsSchedule},
+		{"INACTIVE_ACCOUNTS_SCHEDULE", c.InactiveAccountsSchedule},
+		{"TRASH_PURGE_SCHEDULE", c.TrashPurgeSchedule},
+		{"SUBSCRIBER_EXPIRY_SCHEDULE", c.SubscriberExpirySchedule},
+		{"OVER_QUOTA_TRIM_SCHEDULE", c.OverQuotaTrimSchedule},
+		{"AUDIT_PRUNE_SCHEDULE", c.AuditPruneSchedule},
+	} {
+		if scheduleDisabled(s.spec) {
+			continue
+		}
+		if _, err := parseSchedule(s.spec); err != nil {
+			add("%s: %v (got %q)", s.env, err, s.spec)
+		}
+	}
+	if c.AuditRetentionDays <= 0 {
+		add("AUDIT_RETENTION_DAYS must be positive")
+	}
+	if c.SchedulerLeaseTTL < 3*time.Second {
+		add("SCHEDULER_LEASE_TTL must be at least 3s (got %s)", c.SchedulerLeaseTTL)
+	}
+	if c.ShutdownTimeout <= 0 {
+		add("SHUTDOWN_TIMEOUT must be positive")
+	}
+	if lvl, ok := log.ParseLevel(c.LogLevel); !ok || lvl < log.LevelDebug || lvl > log.LevelPrint {
+		add("LOG_LEVEL must be 0-5 or a level name (got %q)", c.LogLevel)
+	}
+	switch c.LogFormat {
+	case "text", "json", "logfmt":
+	default:
+		add("LOG_FORMAT must be text, json or logfmt (got %q)", c.LogFormat)
+	}
+	return errors.Join(errs...)
+}
+
+// logSummary prints the effective configuration with secrets redacted.
+func (c *Config) logSummary() {
+	for _, f := range c.fields() {
+		val := f.String()
+		if f.Secret {
+			if val == "" {
+				val = "(unset)"
+			} else {
+				val = "(redacted)"
+			}
+		}
+		log.Info("config: %s=%s", f.Env, val)
+	}
+}
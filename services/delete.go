@@ -44,67 +44,125 @@ func (d *DeleteRequest) UnmarshalJSON(data []byte) error {
 
 func init() {
 	http.HandleFunc("/delete", deleteHandler)
+	http.HandleFunc("/undelete", undeleteHandler)
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
+// authorizeOwner decodes a DeleteRequest and checks the Argon token against the
+// one stored for the account. On failure it writes the response and returns nil.
+func authorizeOwner(w http.ResponseWriter, r *http.Request, action string) (*DeleteRequest, *auditEvent, *sql.DB) {
+	logger := log.FromContext(r.Context())
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Debug("delete: invalid method %s", r.Method)
-		return
+		logger.Debug("%s: invalid method %s", action, r.Method)
+		return nil, nil, nil
 	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Warn("delete: read body error: %v", err)
+		logger.Warn("%s: read body error: %v", action, err)
 		http.Error(w, "Failed to read request", http.StatusBadRequest)
-		return
+		return nil, nil, nil
 	}
 	var req DeleteRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Warn("delete: json unmarshal error: %v", err)
+		logger.Warn("%s: json unmarshal error: %v", action, err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+		return nil, nil, nil
 	}
 	if req.AccountId == "" || req.ArgonToken == "" {
-		log.Warn("delete: missing accountId or argonToken")
+		logger.Warn("%s: missing accountId or argonToken", action)
 		http.Error(w, "Missing Account ID or Argon Token", http.StatusBadRequest)
-		return
+		return nil, nil, nil
 	}
+	logger = logger.With("account_id", req.AccountId)
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
+	audit := newAuditEvent(r, action, req.AccountId)
 
 	db := DB
 	if db == nil {
-		log.Error("delete: DB not initialized")
+		logger.Error("%s: DB not initialized", action)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		audit.record()
+		return nil, nil, nil
 	}
 
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
 	var storedToken sql.NullString
 	row := db.QueryRowContext(ctx, "SELECT argon_token FROM accounts WHERE account_id = ?", req.AccountId)
 	switch err := row.Scan(&storedToken); err {
 	case sql.ErrNoRows:
-		log.Warn("delete: account not found %s", req.AccountId)
+		logger.Warn("%s: account not found %s", action, req.AccountId)
+		audit.Result = "not_found"
 		http.Error(w, "Account not found", http.StatusForbidden)
-		return
 	case nil:
-		if !storedToken.Valid || storedToken.String != req.ArgonToken {
-			log.Warn("delete: argon token mismatch for account %s", req.AccountId)
-			http.Error(w, "Invalid argon token", http.StatusForbidden)
-			return
+		if storedToken.Valid && storedToken.String == req.ArgonToken {
+			touchActivity(ctx, db, req.AccountId)
+			return &req, audit, db
 		}
+		logger.Warn("%s: argon token mismatch for account %s", action, req.AccountId)
+		audit.Result = "denied"
+		http.Error(w, "Invalid argon token", http.StatusForbidden)
 	default:
-		log.Error("delete: account lookup error: %v", err)
+		logger.Error("%s: account lookup error: %v", action, err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+	audit.record()
+	return nil, nil, nil
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	req, audit, db := authorizeOwner(w, r, "delete")
+	if req == nil {
 		return
 	}
+	defer audit.record()
+	logger := log.FromContext(r.Context()).With("account_id", req.AccountId)
 
-	if _, err := db.ExecContext(ctx, "DELETE FROM saves WHERE account_id = ?", req.AccountId); err != nil {
-		log.Error("delete: delete save error: %v", err)
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	if _, err := deleteBackup(ctx, db, req.AccountId); err != nil {
+		logger.Error("delete: delete save error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
+	audit.Result = "ok"
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte("1"))
+}
+
+// undeleteHandler lets the owner take a deleted backup out of the trash within
+// RECOVERY_WINDOW_DAYS.
+func undeleteHandler(w http.ResponseWriter, r *http.Request) {
+	req, audit, db := authorizeOwner(w, r, "undelete")
+	if req == nil {
+		return
+	}
+	defer audit.record()
+	logger := log.FromContext(r.Context()).With("account_id", req.AccountId)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+
+	restored, err := undeleteBackup(ctx, db, req.AccountId)
+	if err != nil {
+		logger.Error("undelete: restore error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !restored {
+		audit.Result = "not_found"
+		http.Error(w, "No deleted backup to restore", http.StatusNotFound)
+		return
+	}
+
+	logger.Done("Restored deleted backup: %s", req.AccountId)
+	audit.Result = "ok"
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte("1"))
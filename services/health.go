@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+var startedAt = time.Now()
+
+// Argon reachability is probed at most once per argonProbeInterval so that
+// frequent readiness checks don't hammer the upstream service.
+const argonProbeInterval = 30 * time.Second
+
+var argonProbe struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	ok        bool
+	detail    string
+}
+
+type checkResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func init() {
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
+}
+
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        "ok",
+		"uptimeSeconds": int64(time.Since(startedAt).Seconds()),
+	})
+}
+
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]checkResult{}
+	ready := true
+
+	db := DB
+	if db == nil {
+		checks["database"] = checkResult{Status: "fail", Detail: "not initialized"}
+		ready = false
+	} else if err := db.PingContext(ctx); err != nil {
+		checks["database"] = checkResult{Status: "fail", Detail: err.Error()}
+		ready = false
+	} else {
+		checks["database"] = checkResult{Status: "ok"}
+	}
+
+	if migrationsApplied.Load() {
+		checks["migrations"] = checkResult{Status: "ok"}
+	} else {
+		checks["migrations"] = checkResult{Status: "fail", Detail: "startup migrations not applied"}
+		ready = false
+	}
+
+	// Argon being down only degrades the server: cached validations still work
+	if ok, detail := probeArgon(ctx); ok {
+		checks["argon"] = checkResult{Status: "ok"}
+	} else {
+		checks["argon"] = checkResult{Status: "degraded", Detail: detail}
+	}
+
+	status := "ready"
+	code := http.StatusOK
+	if !ready {
+		status = "not_ready"
+		code = http.StatusServiceUnavailable
+		log.FromContext(r.Context()).Warn("readyz: not ready: %v", checks)
+	} else if checks["argon"].Status != "ok" {
+		status = "degraded"
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+func probeArgon(ctx context.Context) (bool, string) {
+	argonProbe.mu.Lock()
+	defer argonProbe.mu.Unlock()
+	if !argonProbe.checkedAt.IsZero() && time.Since(argonProbe.checkedAt) < argonProbeInterval {
+		return argonProbe.ok, argonProbe.detail
+	}
+
+	ok, detail := true, ""
+	base := cfg().ArgonBaseURL
+	u, err := url.Parse(base)
+	if base == "" || err != nil {
+		ok, detail = false, "ARGON_BASE_URL not configured"
+	} else {
+		// Any HTTP response means Argon is reachable; only transport errors count
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.Scheme+"://"+u.Host, nil)
+		if err == nil {
+			client := &http.Client{Timeout: 3 * time.Second}
+			var resp *http.Response
+			resp, err = client.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}
+		if err != nil {
+			ok, detail = false, err.Error()
+		}
+	}
+
+	argonProbe.checkedAt = time.Now()
+	argonProbe.ok = ok
+	argonProbe.detail = detail
+	return ok, detail
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Background work runs as named jobs. The scheduler checks once a minute, on
+// the replica holding the scheduler lease, for jobs whose schedule has fired
+// since their last recorded run in job_runs, and runs them one at a time.
+// Because due-ness is derived from job_runs, a job missed while no replica was
+// up runs as soon as one is, and schedule changes apply on config reload.
+//
+// There are deliberately no upload-session GC or version-pruning jobs: saves
+// arrive in a single request, so there are no upload sessions to collect, and
+// each account keeps a single backup, so there are no older versions to prune.
+// Add them here if either of those changes.
+
+type job struct {
+	Name    string
+	Timeout time.Duration
+	// schedule returns the job's schedule spec from the active config
+	schedule func(c *Config) string
+	run      func(ctx context.Context) (string, error)
+}
+
+type jobRun struct {
+	ID         int64      `json:"id"`
+	Job        string     `json:"job"`
+	Instance   string     `json:"instance"`
+	Trigger    string     `json:"trigger"`
+	Status     string     `json:"status"`
+	Message    string     `json:"message"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt"`
+}
+
+var errJobRunning = errors.New("job is already running")
+
+// cleanupJob runs the given cleanup phases, or all of them if none are given,
+// and persists the report.
+func cleanupJob(name string, timeout time.Duration, schedule func(c *Config) string, phases ...string) job {
+	return job{
+		Name:     name,
+		Timeout:  timeout,
+		schedule: schedule,
+		run: func(ctx context.Context) (string, error) {
+			report, err := performCleanup(ctx, false, phases...)
+			if err != nil {
+				return "", err
+			}
+			if len(report.Errors) > 0 {
+				return report.summary(), errors.New(report.Errors[0])
+			}
+			return report.summary(), nil
+		},
+	}
+}
+
+var jobs = []job{
+	cleanupJob(phaseExpiryWarnings, 10*time.Minute, func(c *Config) string { return c.ExpiryWarningsSchedule }, phaseExpiryWarnings),
+	cleanupJob(phaseInactiveAccounts, 30*time.Minute, func(c *Config) string { return c.InactiveAccountsSchedule }, phaseInactiveAccounts),
+	cleanupJob(phaseTrashPurge, 30*time.Minute, func(c *Config) string { return c.TrashPurgeSchedule }, phaseTrashPurge),
+	cleanupJob(phaseSubscriberExpiry, 2*time.Minute, func(c *Config) string { return c.SubscriberExpirySchedule }, phaseSubscriberExpiry),
+	cleanupJob(phaseOverQuotaTrim, 30*time.Minute, func(c *Config) string { return c.OverQuotaTrimSchedule }, phaseOverQuotaTrim),
+	cleanupJob(phaseAuditPrune, 10*time.Minute, func(c *Config) string { return c.AuditPruneSchedule }, phaseAuditPrune),
+}
+
+// fullCleanupJob runs every cleanup phase at once. It has no schedule and is
+// only started from /admin/cleanup.
+var fullCleanupJob = cleanupJob("cleanup", 10*time.Minute, nil)
+
+func findJob(name string) (job, bool) {
+	for _, j := range jobs {
+		if j.Name == name {
+			return j, true
+		}
+	}
+	return job{}, false
+}
+
+var (
+	jobsRunningMu sync.Mutex
+	jobsRunning   = map[string]bool{}
+)
+
+func isJobRunning(name string) bool {
+	jobsRunningMu.Lock()
+	defer jobsRunningMu.Unlock()
+	return jobsRunning[name]
+}
+
+// startScheduler runs due jobs every minute until shutdown starts. Runs are
+// tracked in backgroundJobs so shutdown can wait for them; cancelling ctx aborts
+// a run that is still in progress.
+func startScheduler(ctx context.Context) {
+	schedulerLease.maintain(ctx)
+
+	goBackground(func() {
+		log.Info("jobs: scheduler started (%d jobs)", len(jobs))
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			runDueJobs(ctx)
+			select {
+			case <-shutdownStarted:
+				log.Info("jobs: scheduler stopped")
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	})
+}
+
+func runDueJobs(ctx context.Context) {
+	if !schedulerLease.isHeld() {
+		return
+	}
+	db := DB
+	if db == nil || !migrationsApplied.Load() {
+		return
+	}
+
+	lctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	last, err := lastJobRuns(lctx, db)
+	cancel()
+	if err != nil {
+		log.Warn("jobs: failed to load last runs: %v", err)
+		return
+	}
+
+	conf := cfg()
+	for _, j := range jobs {
+		select {
+		case <-shutdownStarted:
+			return
+		default:
+		}
+		next, ok := nextJobRun(conf, j, last[j.Name])
+		if !ok || next.After(time.Now()) {
+			continue
+		}
+		if _, err := runJob(ctx, j, "schedule"); err != nil && !errors.Is(err, errJobRunning) {
+			log.Warn("jobs: %s failed: %v", j.Name, err)
+		}
+	}
+}
+
+// nextJobRun returns when a job is next due given its last run. A job that has
+// never run is due now. ok is false if the job is disabled.
+func nextJobRun(conf *Config, j job, last *jobRun) (time.Time, bool) {
+	spec := j.schedule(conf)
+	if scheduleDisabled(spec) {
+		return time.Time{}, false
+	}
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		// Config validation rejects these; don't run on a bad spec regardless
+		return time.Time{}, false
+	}
+	if last == nil {
+		return time.Now(), true
+	}
+	return sched.next(last.StartedAt), true
+}
+
+// runJob runs j now, recording the run in job_runs. trigger is "schedule" or
+// "manual".
+func runJob(ctx context.Context, j job, trigger string) (*jobRun, error) {
+	jobsRunningMu.Lock()
+	if jobsRunning[j.Name] {
+		jobsRunningMu.Unlock()
+		return nil, errJobRunning
+	}
+	jobsRunning[j.Name] = true
+	jobsRunningMu.Unlock()
+	defer func() {
+		jobsRunningMu.Lock()
+		delete(jobsRunning, j.Name)
+		jobsRunningMu.Unlock()
+	}()
+
+	run := &jobRun{Job: j.Name, Instance: instanceID(), Trigger: trigger, Status: "running", StartedAt: time.Now()}
+	if err := insertJobRun(ctx, run); err != nil {
+		return nil, fmt.Errorf("record job run: %w", err)
+	}
+
+	log.Info("jobs: running %s (%s)", j.Name, trigger)
+	jctx, cancel := context.WithTimeout(ctx, j.Timeout)
+	msg, err := j.run(jctx)
+	timedOut := errors.Is(jctx.Err(), context.DeadlineExceeded)
+	cancel()
+
+	finished := time.Now()
+	run.FinishedAt = &finished
+	run.Message = msg
+	switch {
+	case timedOut:
+		run.Status = "timeout"
+		run.Message = fmt.Sprintf("timed out after %s; %s", j.Timeout, msg)
+	case err != nil:
+		run.Status = "error"
+		run.Message = err.Error()
+		if msg != "" {
+			run.Message += "; " + msg
+		}
+	default:
+		run.Status = "ok"
+	}
+	jobRuns.Inc(j.Name, run.Status)
+	jobDuration.Observe(finished.Sub(run.StartedAt).Seconds(), j.Name)
+	log.Info("jobs: %s finished with status %s in %s: %s", j.Name, run.Status, finished.Sub(run.StartedAt).Round(time.Millisecond), run.Message)
+
+	if err := finishJobRun(ctx, run); err != nil {
+		log.Warn("jobs: failed to record result of %s: %v", j.Name, err)
+	}
+	if run.Status != "ok" {
+		return run, fmt.Errorf("%s: %s", run.Status, run.Message)
+	}
+	return run, nil
+}
+
+func insertJobRun(ctx context.Context, run *jobRun) error {
+	db := DB
+	if db == nil {
+		return fmt.Errorf("DB not initialized")
+	}
+	res, err := db.ExecContext(ctx, "INSERT INTO job_runs (job_name, instance, trigger_source, status, started_at) VALUES (?, ?, ?, ?, ?)",
+		run.Job, run.Instance, run.Trigger, run.Status, run.StartedAt)
+	if err != nil {
+		return err
+	}
+	run.ID, err = res.LastInsertId()
+	return err
+}
+
+func finishJobRun(ctx context.Context, run *jobRun) error {
+	// Record the outcome even if the run was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	_, err := DB.ExecContext(ctx, "UPDATE job_runs SET status = ?, message = ?, finished_at = ? WHERE id = ?",
+		run.Status, run.Message, run.FinishedAt, run.ID)
+	return err
+}
+
+// lastJobRuns returns the most recent run of each job.
+func lastJobRuns(ctx context.Context, db *sql.DB) (map[string]*jobRun, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, job_name, instance, trigger_source, status, message, started_at, finished_at
+		FROM job_runs WHERE id IN (SELECT MAX(id) FROM job_runs GROUP BY job_name)`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[string]*jobRun{}
+	for rows.Next() {
+		var r jobRun
+		var msg sql.NullString
+		var finished sql.NullTime
+		if err := rows.Scan(&r.ID, &r.Job, &r.Instance, &r.Trigger, &r.Status, &msg, &r.StartedAt, &finished); err != nil {
+			return nil, err
+		}
+		r.Message = msg.String
+		r.FinishedAt = nullTimePtr(finished)
+		out[r.Job] = &r
+	}
+	return out, rows.Err()
+}
+
+type jobStatus struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	Timeout  string     `json:"timeout"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"nextRun"`
+	LastRun  *jobRun    `json:"lastRun"`
+}
+
+// listJobs describes every job with its schedule and last run.
+func listJobs(ctx context.Context, db *sql.DB) ([]jobStatus, error) {
+	last, err := lastJobRuns(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	conf := cfg()
+	out := make([]jobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		st := jobStatus{
+			Name:     j.Name,
+			Schedule: j.schedule(conf),
+			Timeout:  j.Timeout.String(),
+			Running:  isJobRunning(j.Name),
+			LastRun:  last[j.Name],
+		}
+		if next, ok := nextJobRun(conf, j, last[j.Name]); ok {
+			st.NextRun = &next
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
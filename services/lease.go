@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Scheduled jobs must run on one replica only. Replicas compete for a row in
+// scheduler_leases; the holder renews it every third of SCHEDULER_LEASE_TTL and
+// another replica takes over once it has expired, e.g. after a crash.
+
+const schedulerLeaseName = "scheduler"
+
+type lease struct {
+	name   string
+	holder string
+	held   atomic.Bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+var schedulerLease = &lease{name: schedulerLeaseName}
+
+// instanceID identifies this process in scheduler_leases and metrics.
+func instanceID() string {
+	if id := cfg().InstanceID; id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+func (l *lease) isHeld() bool {
+	return l.held.Load()
+}
+
+// tryAcquire takes the lease if it is free or expired, or renews it if this
+// instance already holds it. It reports whether this instance holds it now.
+func (l *lease) tryAcquire(ctx context.Context, db *sql.DB, ttl time.Duration) (bool, error) {
+	seconds := int(ttl.Seconds())
+	// MySQL applies the assignments left to right, so expires_at is only
+	// extended when holder is (now) us.
+	_, err := db.ExecContext(ctx, `INSERT INTO scheduler_leases (name, holder, expires_at)
+		VALUES (?, ?, DATE_ADD(NOW(), INTERVAL ? SECOND))
+		ON DUPLICATE KEY UPDATE
+			holder = IF(expires_at < NOW() OR holder = VALUES(holder), VALUES(holder), holder),
+			expires_at = IF(holder = VALUES(holder), VALUES(expires_at), expires_at)`,
+		l.name, l.holder, seconds)
+	if err != nil {
+		return false, err
+	}
+	var holder string
+	if err := db.QueryRowContext(ctx, "SELECT holder FROM scheduler_leases WHERE name = ?", l.name).Scan(&holder); err != nil {
+		return false, err
+	}
+	return holder == l.holder, nil
+}
+
+func (l *lease) release(ctx context.Context, db *sql.DB) {
+	if !l.held.Swap(false) {
+		return
+	}
+	if _, err := db.ExecContext(ctx, "DELETE FROM scheduler_leases WHERE name = ? AND holder = ?", l.name, l.holder); err != nil {
+		log.Warn("lease: failed to release %s: %v", l.name, err)
+		return
+	}
+	log.Info("lease: released %s", l.name)
+}
+
+// maintain acquires or renews the lease in the background until stopAndRelease
+// is called or ctx is cancelled. After shutdown starts a held lease is still
+// renewed so a running job isn't taken over, but a free one isn't taken.
+func (l *lease) maintain(ctx context.Context) {
+	l.holder = instanceID()
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	ttl := cfg().SchedulerLeaseTTL
+
+	renew := func() {
+		db := DB
+		if db == nil {
+			return
+		}
+		select {
+		case <-shutdownStarted:
+			if !l.isHeld() {
+				return
+			}
+		default:
+		}
+		rctx, cancel := context.WithTimeout(ctx, ttl/3)
+		defer cancel()
+		ok, err := l.tryAcquire(rctx, db, ttl)
+		if err != nil {
+			// Stop acting as leader; the lease will expire if we can't reach the DB
+			log.Warn("lease: failed to renew %s: %v", l.name, err)
+			ok = false
+		}
+		if was := l.held.Swap(ok); was != ok {
+			if ok {
+				log.Info("lease: %s acquired by %s", l.name, l.holder)
+			} else {
+				log.Info("lease: %s lost by %s", l.name, l.holder)
+			}
+		}
+	}
+
+	renew()
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				renew()
+			}
+		}
+	}()
+}
+
+// stopAndRelease stops renewing and gives the lease up so another replica can
+// take over without waiting for it to expire. Shutdown calls it once background
+// jobs have finished.
+func (l *lease) stopAndRelease() {
+	if l.stop == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+
+	db := DB
+	if db == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	l.release(ctx, db)
+}
+
+// currentLeaseHolder returns the unexpired holder of a lease, or "" if none.
+func currentLeaseHolder(ctx context.Context, db *sql.DB, name string) (string, error) {
+	var holder string
+	err := db.QueryRowContext(ctx, "SELECT holder FROM scheduler_leases WHERE name = ? AND expires_at >= NOW()", name).Scan(&holder)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return holder, err
+}
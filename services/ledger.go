@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Payments are recorded once each in the payments ledger, keyed by the
+// provider's transaction ID. A membership's expiry is recomputed from its ledger
+// entries instead of being bumped in place, so a retried webhook can't extend a
+// membership twice. Refunds mark the refunded entry, and cancellations and
+// operator adjustments are entries of their own, so they replay the same way.
+
+type ledgerEntry struct {
+	ID            int64      `json:"id"`
+	Provider      string     `json:"provider"`
+	TransactionID string     `json:"transactionId"`
+	MembershipID  int64      `json:"-"`
+	Type          string     `json:"type"`
+	TierName      string     `json:"tierName"`
+	Amount        string     `json:"amount"`
+	Currency      string     `json:"currency"`
+	Months        int        `json:"months"`
+	Days          int        `json:"days"`
+	Cancellation  bool       `json:"cancellation"`
+	PaidAt        time.Time  `json:"paidAt"`
+	RefundedAt    *time.Time `json:"refundedAt"`
+	StartsAt      time.Time  `json:"startsAt"`
+	EndsAt        time.Time  `json:"endsAt"`
+}
+
+var (
+	errDuplicatePayment = errors.New("payment already recorded")
+	errPaymentNotFound  = errors.New("payment not found")
+)
+
+// mysqlDuplicateKey is the MySQL error number for a unique key violation.
+const mysqlDuplicateKey = 1062
+
+// insertPayment adds e to the ledger. It returns errDuplicatePayment if the
+// provider already delivered this transaction ID. Call syncMembershipExpiry
+// afterwards.
+func insertPayment(ctx context.Context, tx *sql.Tx, e *ledgerEntry) error {
+	res, err := tx.ExecContext(ctx, `INSERT INTO payments (provider, transaction_id, membership_id, type, tier_name, amount, currency, months, days, cancellation, paid_at, starts_at, ends_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Provider, e.TransactionID, e.MembershipID, e.Type, e.TierName, e.Amount, e.Currency, e.Months, e.Days, e.Cancellation, e.PaidAt, e.PaidAt, e.PaidAt)
+	var myErr *mysql.MySQLError
+	if errors.As(err, &myErr) && myErr.Number == mysqlDuplicateKey {
+		return errDuplicatePayment
+	}
+	if err != nil {
+		return fmt.Errorf("insert payment: %w", err)
+	}
+	e.ID, err = res.LastInsertId()
+	return err
+}
+
+// addManualPayment records days granted by an operator as a ledger entry.
+// Negative days shorten the membership.
+func addManualPayment(ctx context.Context, tx *sql.Tx, membershipID int64, days int) error {
+	return insertPayment(ctx, tx, &ledgerEntry{
+		Provider:      "manual",
+		TransactionID: newRequestID(),
+		MembershipID:  membershipID,
+		Type:          "Manual",
+		Days:          days,
+		PaidAt:        time.Now(),
+	})
+}
+
+// addCancellation ends a membership now. Later payments start it again.
+func addCancellation(ctx context.Context, tx *sql.Tx, membershipID int64, provider, transactionID string) error {
+	return insertPayment(ctx, tx, &ledgerEntry{
+		Provider:      provider,
+		TransactionID: transactionID,
+		MembershipID:  membershipID,
+		Type:          "Cancellation",
+		Cancellation:  true,
+		PaidAt:        time.Now(),
+	})
+}
+
+// replayLedger lays a membership's entries end to end in payment order: each
+// period starts when it was paid or when the previous one ends, whichever is
+// later. It fills in StartsAt and EndsAt and returns the resulting expiry.
+//
+// Refunded entries count for nothing. Cancellations cut the membership off at
+// the time they were recorded, and negative periods shorten it, though never
+// to before the adjustment was made. Entries without a period, carried over
+// from before the ledger, keep their recorded span.
+func replayLedger(entries []ledgerEntry) time.Time {
+	var expiry time.Time
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case e.RefundedAt != nil:
+			e.StartsAt, e.EndsAt = e.PaidAt, e.PaidAt
+			continue
+		case e.Cancellation || e.Months < 0 || e.Days < 0:
+			cut := e.PaidAt
+			if !e.Cancellation {
+				if shortened := expiry.AddDate(0, e.Months, e.Days); shortened.After(cut) {
+					cut = shortened
+				}
+			}
+			if expiry.IsZero() || expiry.After(cut) {
+				expiry = cut
+			}
+			e.StartsAt, e.EndsAt = cut, cut
+			continue
+		case e.Months != 0 || e.Days != 0:
+			e.StartsAt = e.PaidAt
+			if expiry.After(e.StartsAt) {
+				e.StartsAt = expiry
+			}
+			e.EndsAt = e.StartsAt.AddDate(0, e.Months, e.Days)
+		}
+		if e.EndsAt.After(expiry) {
+			expiry = e.EndsAt
+		}
+	}
+	return expiry
+}
+
+// syncMembershipExpiry recomputes a membership's expiry from the ledger and
+// refreshes subscriber status and quota state of the linked account. It
+// returns the new expiry and the linked account, if any. Memberships without an
+// expiry never lapse and are left alone.
+func syncMembershipExpiry(ctx context.Context, tx *sql.Tx, membershipID int64) (time.Time, string, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, months, days, cancellation, paid_at, refunded_at, starts_at, ends_at FROM payments WHERE membership_id = ? ORDER BY paid_at, id FOR UPDATE", membershipID)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("ledger lookup: %w", err)
+	}
+	var entries []ledgerEntry
+	for rows.Next() {
+		var e ledgerEntry
+		var refunded, starts, ends sql.NullTime
+		if err := rows.Scan(&e.ID, &e.Months, &e.Days, &e.Cancellation, &e.PaidAt, &refunded, &starts, &ends); err != nil {
+			rows.Close()
+			return time.Time{}, "", fmt.Errorf("ledger scan: %w", err)
+		}
+		e.RefundedAt = nullTimePtr(refunded)
+		e.StartsAt, e.EndsAt = starts.Time, ends.Time
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return time.Time{}, "", err
+	}
+
+	recorded := make([]ledgerEntry, len(entries))
+	copy(recorded, entries)
+	expiry := replayLedger(entries)
+	for i, e := range entries {
+		if e.StartsAt.Equal(recorded[i].StartsAt) && e.EndsAt.Equal(recorded[i].EndsAt) {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE payments SET starts_at = ?, ends_at = ? WHERE id = ?", e.StartsAt, e.EndsAt, e.ID); err != nil {
+			return time.Time{}, "", fmt.Errorf("ledger update: %w", err)
+		}
+	}
+
+	if len(entries) > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE memberships SET expires_at = ? WHERE id = ? AND expires_at IS NOT NULL", expiry, membershipID); err != nil {
+			return time.Time{}, "", fmt.Errorf("membership update: %w", err)
+		}
+	}
+
+	var accountID sql.NullString
+	if err := tx.QueryRowContext(ctx, "SELECT account_id FROM memberships WHERE id = ?", membershipID).Scan(&accountID); err != nil {
+		return time.Time{}, "", fmt.Errorf("membership lookup: %w", err)
+	}
+	if accountID.String != "" {
+		if err := refreshSubscriber(ctx, tx, accountID.String); err != nil {
+			return time.Time{}, "", err
+		}
+		if err := updateQuotaState(ctx, tx, accountID.String); err != nil {
+			return time.Time{}, "", err
+		}
+	}
+	return expiry, accountID.String, nil
+}
+
+// refundPayment stops a payment from counting towards its membership. Refunding
+// an already refunded payment changes nothing. It returns the linked account,
+// if any, or errPaymentNotFound.
+func refundPayment(ctx context.Context, db *sql.DB, provider, transactionID string) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var membershipID int64
+	err = tx.QueryRowContext(ctx, "SELECT membership_id FROM payments WHERE provider = ? AND transaction_id = ? AND cancellation = FALSE FOR UPDATE", provider, transactionID).Scan(&membershipID)
+	if err == sql.ErrNoRows {
+		return "", errPaymentNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("payment lookup: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE payments SET refunded_at = CURRENT_TIMESTAMP WHERE provider = ? AND transaction_id = ? AND refunded_at IS NULL", provider, transactionID); err != nil {
+		return "", fmt.Errorf("refund payment: %w", err)
+	}
+	expiry, accountID, err := syncMembershipExpiry(ctx, tx, membershipID)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	log.FromContext(ctx).Info("payment: refunded %s:%s, membership %d now expires %v", provider, transactionID, membershipID, expiry)
+	return accountID, nil
+}
+
+// refreshSubscriber sets the account's subscriber flag from whether any of its
+// linked memberships is active.
+func refreshSubscriber(ctx context.Context, tx *sql.Tx, accountID string) error {
+	_, err := tx.ExecContext(ctx, `UPDATE accounts SET subscriber = EXISTS (
+			SELECT 1 FROM memberships WHERE account_id = ? AND (expires_at > NOW() OR expires_at IS NULL)
+		) WHERE account_id = ?`, accountID, accountID)
+	if err != nil {
+		return fmt.Errorf("subscriber update: %w", err)
+	}
+	return nil
+}
@@ -16,61 +16,80 @@ func init() {
 }
 
 func loadLevelHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Debug("loadlevel: invalid method %s", r.Method)
+		logger.Debug("loadlevel: invalid method %s", r.Method)
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Warn("loadlevel: read body error: %v", err)
+		logger.Warn("loadlevel: read body error: %v", err)
 		http.Error(w, "Failed to read request", http.StatusBadRequest)
 		return
 	}
 
 	var req LoadRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Error("loadlevel: json unmarshal error: %v", err)
+		logger.Error("loadlevel: json unmarshal error: %v", err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 	if req.AccountId == "" || req.ArgonToken == "" {
-		log.Warn("loadlevel: missing accountId or argonToken")
+		logger.Warn("loadlevel: missing accountId or argonToken")
 		http.Error(w, "Missing Account ID or Argon Token", http.StatusBadRequest)
 		return
 	}
+	logger = logger.With("account_id", req.AccountId)
+
+	audit := newAuditEvent(r, "loadlevel", req.AccountId)
+	defer audit.record()
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
 	db := DB
 	if db == nil {
-		log.Error("loadlevel: DB not initialized")
+		logger.Error("loadlevel: DB not initialized")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	ok, verr := ValidateArgonToken(ctx, db, req.AccountId, req.ArgonToken)
 	if verr != nil {
-		log.Error("loadlevel: token validation error for %s: %v", req.AccountId, verr)
+		logger.Error("loadlevel: token validation error for %s: %v", req.AccountId, verr)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	if !ok {
-		log.Warn("loadlevel: token validation failed for %s", req.AccountId)
+		logger.Warn("loadlevel: token validation failed for %s", req.AccountId)
+		audit.Result = "denied"
 		http.Error(w, "Invalid Argon Token", http.StatusForbidden)
 		return
 	}
 
+	if limited, limits, err := loadLimitReached(ctx, db, req.AccountId); err != nil {
+		logger.Error("loadlevel: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	} else if limited {
+		logger.Warn("loadlevel: %s tier limit of %d loads per hour reached", limits.Name, limits.LoadsPerHour)
+		audit.Result = "rate_limited"
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Too many loads, try again later", http.StatusTooManyRequests)
+		return
+	}
+
 	var levelData sql.NullString
-	r2 := db.QueryRowContext(ctx, "SELECT level_data FROM saves WHERE account_id = ?", req.AccountId)
+	r2 := db.QueryRowContext(ctx, "SELECT level_data FROM saves WHERE account_id = ? AND deleted_at IS NULL", req.AccountId)
 	if err := r2.Scan(&levelData); err != nil {
 		if err == sql.ErrNoRows {
+			audit.Result = "not_found"
 			http.Error(w, "Level data not found", http.StatusNotFound)
 			return
 		}
-		log.Error("loadlevel: save lookup error: %v", err)
+		logger.Error("loadlevel: save lookup error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -80,6 +99,9 @@ func loadLevelHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	audit.Result = "ok"
+	audit.Bytes = int64(len(levelData.String))
+
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write([]byte(levelData.String))
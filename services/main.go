@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"os"
-	"strings"
+	"sync/atomic"
 	"time"
 
 	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
@@ -15,11 +19,28 @@ import (
 )
 
 var DB *sql.DB
-var authToken string
+var migrationsApplied atomic.Bool
 
 func main() {
-	authToken = os.Getenv("AUTHORIZATION_TOKEN")
-	if authToken != "" {
+	// gdaltweb [config flags] [command [args]]
+	conf, rest, err := loadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+	setConfig(conf)
+	configArgs = os.Args[1 : len(os.Args)-len(rest)]
+
+	if len(rest) > 0 && rest[0] != "serve" {
+		os.Exit(runCommand(rest[0], rest[1:]))
+	}
+
+	conf.logSummary()
+	watchReloadSignal()
+	if conf.AuthorizationToken != "" {
 		log.Info("authorization: enabled (token validation required)")
 	}
 
@@ -29,13 +50,10 @@ func main() {
 		log.Done("DB check: connected OK")
 	}
 
-	if err := ensureAccountsMigration(); err != nil {
-		log.Warn("DB migration warning: %v", err)
-	}
-
-	// Ensure saves table exists as well
-	if err := ensureSavesMigration(); err != nil {
-		log.Warn("DB migration warning (saves): %v", err)
+	if !runMigrations() && DB != nil {
+		// Database may still be starting up; keep trying in the background
+		// while /readyz reports not ready.
+		go retryMigrations()
 	}
 
 	http.HandleFunc("/", authMiddleware(func(w http.ResponseWriter, r *http.Request) {
@@ -45,38 +63,26 @@ func main() {
 		//_, _ = w.Write([]byte(""))
 	}))
 
-	startCleanupRoutine()
+	var stopJobs context.CancelFunc
+	jobsCtx, stopJobs = context.WithCancel(context.Background())
+	defer stopJobs()
+	startScheduler(jobsCtx)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3001"
-	}
-	addr := ":" + port
-	log.Done("starting server on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	addr := fmt.Sprintf(":%d", conf.Port)
+	handler := metricsMiddleware(requestLogMiddleware(inFlightMiddleware(http.DefaultServeMux)))
+	if err := serve(addr, handler, stopJobs); err != nil {
 		log.Error("server failed: %v", err)
 	}
 }
 
 func initGlobalDB() error {
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASS")
-	dbHost := os.Getenv("DB_HOST")
-	dbPort := os.Getenv("DB_PORT")
-	dbName := os.Getenv("DB_NAME")
-	if dbUser == "" || dbHost == "" || dbName == "" {
-		return fmt.Errorf("missing DB env vars (DB_USER, DB_HOST, DB_NAME required)")
-	}
-	if dbPort == "" {
-		dbPort = "3306"
-	}
-	dbMaxAllowedPacket := os.Getenv("DB_MAX_ALLOWED_PACKET")
-	if dbMaxAllowedPacket == "" {
-		dbMaxAllowedPacket = "1073741824"
+	conf := cfg()
+	if conf.DBUser == "" || conf.DBHost == "" || conf.DBName == "" {
+		return fmt.Errorf("missing DB config (DB_USER, DB_HOST, DB_NAME required)")
 	}
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4&interpolateParams=true&maxAllowedPacket=%s&timeout=30s&readTimeout=5m&writeTimeout=5m",
-		dbUser, dbPass, dbHost, dbPort, dbName, dbMaxAllowedPacket)
+	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&charset=utf8mb4&interpolateParams=true&maxAllowedPacket=%d&timeout=30s&readTimeout=5m&writeTimeout=5m",
+		conf.DBUser, conf.DBPass, conf.DBHost, conf.DBPort, conf.DBName, conf.DBMaxAllowedPacket)
 
 	db, err := sql.Open("mysql", dsn)
 	if err != nil {
@@ -87,176 +93,78 @@ func initGlobalDB() error {
 	db.SetMaxIdleConns(10)
 	db.SetConnMaxLifetime(10 * time.Minute)
 
+	// Keep the pool even if the first ping fails so it can recover once the
+	// database becomes reachable.
+	DB = db
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := db.PingContext(ctx); err != nil {
 		return err
 	}
-
-	DB = db
 	return nil
 }
 
-func startCleanupRoutine() {
-	go runCleanup()
-
-	// cleanup every 24 hours
-	go func() {
-		log.Info("cleanup: scheduler started (interval: 24h)")
-		ticker := time.NewTicker(24 * time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			runCleanup()
-		}
-	}()
-}
-
-func runCleanup() {
-	log.Debug("cleanup: checking for inactive accounts...")
+// runMigrations applies pending schema migrations (unless AUTO_MIGRATE=false,
+// in which case it only checks that none are pending) and reports whether the
+// schema is up to date.
+func runMigrations() bool {
 	if DB == nil {
-		log.Error("cleanup: DB not initialized")
-		return
+		log.Warn("DB migration warning: DB not initialized")
+		migrationsApplied.Store(false)
+		return false
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
 	defer cancel()
 
-	var totalDeleted int
-	for {
-		// Process them in chunks of 500 to prevent large gap locks blockading incoming `saves`
-		selectQuery := `SELECT a.account_id 
-						FROM accounts a 
-						JOIN saves s ON a.account_id = s.account_id 
-						WHERE s.created_at < DATE_SUB(NOW(), INTERVAL 60 DAY) 
-						LIMIT 500`
-
-		rows, err := DB.QueryContext(ctx, selectQuery)
+	if !cfg().AutoMigrate {
+		statuses, err := migrateStatus(ctx, DB)
 		if err != nil {
-			log.Error("cleanup: failed to find inactive accounts: %v", err)
-			break
+			log.Warn("DB migration warning: %v", err)
+			migrationsApplied.Store(false)
+			return false
 		}
-
-		var accountIDs []string
-		for rows.Next() {
-			var id string
-			if err := rows.Scan(&id); err == nil {
-				accountIDs = append(accountIDs, id)
+		for _, st := range statuses {
+			if st.AppliedAt == nil {
+				log.Warn("DB migration warning: %04d_%s pending (AUTO_MIGRATE disabled, run `gdaltweb migrate up`)", st.Version, st.Name)
+				migrationsApplied.Store(false)
+				return false
 			}
 		}
-		rows.Close()
-
-		if len(accountIDs) == 0 {
-			break
-		}
-
-		args := make([]interface{}, len(accountIDs))
-		placeholders := make([]string, len(accountIDs))
-		for i, id := range accountIDs {
-			args[i] = id
-			placeholders[i] = "?"
-		}
-		inClause := strings.Join(placeholders, ",")
-
-		// Using bulk deletes reduces index tree lock congestion,
-		// but chunking limits the table-lock impact duration
-		deleteSaves := fmt.Sprintf("DELETE FROM saves WHERE account_id IN (%s)", inClause)
-		_, errSaves := DB.ExecContext(ctx, deleteSaves, args...)
-		if errSaves != nil {
-			log.Warn("cleanup: chunk saves delete error: %v", errSaves)
-		}
-
-		deleteAccounts := fmt.Sprintf("DELETE FROM accounts WHERE account_id IN (%s)", inClause)
-		_, errAcc := DB.ExecContext(ctx, deleteAccounts, args...)
-		if errAcc != nil {
-			log.Warn("cleanup: chunk accounts delete error: %v", errAcc)
-		}
-
-		totalDeleted += len(accountIDs)
-		time.Sleep(100 * time.Millisecond) // Yield the table briefly
+		migrationsApplied.Store(true)
+		return true
 	}
 
-	if totalDeleted > 0 {
-		log.Info("cleanup: removed %d inactive rows (accounts+saves)", totalDeleted)
-	} else {
-		log.Debug("cleanup: no inactive accounts found")
+	n, err := migrateUp(ctx, DB)
+	if err != nil {
+		log.Warn("DB migration warning: %v", err)
+		migrationsApplied.Store(false)
+		return false
 	}
-
-	// Cleanup expired memberships / subscribers
-	subQuery := `UPDATE accounts a 
-				 SET subscriber = 0 
-				 WHERE subscriber = 1 
-				 AND NOT EXISTS (
-					 SELECT 1 FROM memberships m 
-					 WHERE m.account_id = a.account_id 
-					 AND (m.expires_at > NOW() OR m.expires_at IS NULL)
-				 )`
-	if resSub, err := DB.ExecContext(ctx, subQuery); err != nil {
-		log.Error("cleanup: failed to update expired subscribers: %v", err)
-	} else {
-		if rows, _ := resSub.RowsAffected(); rows > 0 {
-			log.Info("cleanup: removed subscriber status from %d expired accounts", rows)
-		}
+	if n > 0 {
+		log.Done("DB migrations: applied %d migration(s)", n)
 	}
+	migrationsApplied.Store(true)
+	return true
 }
 
-func ensureAccountsMigration() error {
-	if DB == nil {
-		return fmt.Errorf("DB not initialized")
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	acctCreate := `CREATE TABLE IF NOT EXISTS accounts (
-		account_id VARCHAR(255) PRIMARY KEY,
-		argon_token VARCHAR(512) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		token_validated_at TIMESTAMP NULL
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
-	if _, err := DB.ExecContext(ctx, acctCreate); err != nil {
-		return err
-	}
-
-	if _, err := DB.ExecContext(ctx, "ALTER TABLE accounts ADD COLUMN token_validated_at TIMESTAMP NULL"); err != nil {
-		if !strings.Contains(err.Error(), "Duplicate column name") && !strings.Contains(err.Error(), "exists") {
-			return err
-		}
-	}
-	if _, err := DB.ExecContext(ctx, "ALTER TABLE accounts ADD COLUMN subscriber BOOLEAN DEFAULT FALSE"); err != nil {
-		if !strings.Contains(err.Error(), "Duplicate column name") && !strings.Contains(err.Error(), "exists") {
-			return err
+func retryMigrations() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if runMigrations() {
+			log.Done("DB check: migrations applied after retry")
+			return
 		}
 	}
-	return nil
-}
-
-func ensureSavesMigration() error {
-	if DB == nil {
-		return fmt.Errorf("DB not initialized")
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	createStmt := `CREATE TABLE IF NOT EXISTS saves (
-		id BIGINT AUTO_INCREMENT PRIMARY KEY,
-		account_id VARCHAR(255) NOT NULL,
-		save_data LONGTEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		UNIQUE KEY unique_account (account_id)
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
-
-	if _, err := DB.ExecContext(ctx, createStmt); err != nil {
-		return err
-	}
-	return nil
 }
 
 func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if authToken != "" {
+		if token := cfg().AuthorizationToken; token != "" {
 			reqToken := r.Header.Get("Authorization")
-			if subtle.ConstantTimeCompare([]byte(reqToken), []byte(authToken)) != 1 {
+			if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
@@ -264,3 +172,38 @@ func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}
 }
+
+// requestLogMiddleware assigns every request an ID (honouring an incoming
+// X-Request-ID), makes it available to handler loggers via the request context
+// and logs the request once it completes.
+func requestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		reqID := r.Header.Get("X-Request-ID")
+		if reqID == "" || len(reqID) > 64 {
+			reqID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", reqID)
+
+		route := metricsRoute(r)
+		ctx := log.WithRequestID(r.Context(), reqID)
+		logger := log.FromContext(ctx).With("route", route)
+		ctx = log.NewContext(ctx, logger)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		logger.With("status", rec.status, "duration", time.Since(start), "remote_addr", r.RemoteAddr).Debug("%s %s", r.Method, r.URL.Path)
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -2,10 +2,16 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net/http"
 	"strings"
 	"time"
@@ -14,9 +20,11 @@ import (
 )
 
 type MembershipRequest struct {
-	Email      string `json:"email"`
-	AccountId  string `json:"accountId"`
-	ArgonToken string `json:"argonToken"`
+	Email           string `json:"email"`
+	AccountId       string `json:"accountId"`
+	ArgonToken      string `json:"argonToken"`
+	Code            string `json:"code"`
+	TargetAccountId string `json:"targetAccountId"`
 }
 
 func (m *MembershipRequest) UnmarshalJSON(data []byte) error {
@@ -46,181 +54,323 @@ func (m *MembershipRequest) UnmarshalJSON(data []byte) error {
 	m.Email = getStr("email")
 	m.AccountId = getStr("accountId", "account_id")
 	m.ArgonToken = getStr("argonToken", "argon_token")
+	m.Code = strings.TrimSpace(getStr("code", "verificationCode", "verification_code"))
+	m.TargetAccountId = getStr("targetAccountId", "target_account_id")
 	return nil
 }
 
-func init() {
-	http.HandleFunc("/membership", membershipHandler)
-}
+// Linking a Ko-fi email to an account takes two requests. The first, without a
+// code, sends a verification code to the owner of the email (see notifier.go);
+// its response is the same whether or not the email belongs to a membership.
+// The second repeats the request with the code and links the membership.
 
-func ensureMembershipsTable(ctx context.Context, db *sql.DB) error {
-
-	// Create table if not exists (matching schema + account_id + expires_at)
-	query := `CREATE TABLE IF NOT EXISTS memberships (
-		id INT AUTO_INCREMENT PRIMARY KEY,
-		kofi_transaction_id VARCHAR(255),
-		email VARCHAR(255),
-		discord_username VARCHAR(255),
-		discord_userid VARCHAR(255),
-		tier_name VARCHAR(255),
-		account_id VARCHAR(255),
-		expires_at TIMESTAMP NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
-	if _, err := db.ExecContext(ctx, query); err != nil {
-		return err
-	}
+const (
+	// maxVerificationAttempts is how many wrong codes end a verification.
+	maxVerificationAttempts = 5
+	// maxVerificationCodesPerHour limits how many codes an account can request.
+	maxVerificationCodesPerHour = 5
+)
 
-	// Ensure account_id column exists (migration for existing table)
-	if _, err := db.ExecContext(ctx, "ALTER TABLE memberships ADD COLUMN account_id VARCHAR(255)"); err != nil {
-		if !strings.Contains(err.Error(), "Duplicate column name") && !strings.Contains(err.Error(), "exists") {
-			return err
-		}
-	}
+var (
+	errVerificationFailed = errors.New("invalid or expired verification code")
+	errMembershipLinked   = errors.New("membership already linked to another account")
+)
 
-	// Ensure expires_at column exists
-	if _, err := db.ExecContext(ctx, "ALTER TABLE memberships ADD COLUMN expires_at TIMESTAMP NULL"); err != nil {
-		if !strings.Contains(err.Error(), "Duplicate column name") && !strings.Contains(err.Error(), "exists") {
-			return err
-		}
-	}
-	return nil
+func init() {
+	http.HandleFunc("/membership", membershipHandler)
 }
 
-func membershipHandler(w http.ResponseWriter, r *http.Request) {
+// decodeMembershipRequest reads a POSTed MembershipRequest that carries at
+// least an account ID and Argon token. It writes the error response on failure.
+func decodeMembershipRequest(w http.ResponseWriter, r *http.Request) (*MembershipRequest, bool) {
+	logger := log.FromContext(r.Context())
 	if r.Method != http.MethodPost {
-		log.Warn("membership: invalid method %s", r.Method)
+		logger.Warn("membership: invalid method %s", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+		return nil, false
 	}
 
 	body, readErr := io.ReadAll(r.Body)
 	if readErr != nil {
-		log.Warn("membership: read body error: %v", readErr)
+		logger.Warn("membership: read body error: %v", readErr)
 		http.Error(w, "Failed to read request", http.StatusBadRequest)
-		return
+		return nil, false
 	}
 
 	var req MembershipRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Warn("membership: json unmarshal error: %v", err)
+		logger.Warn("membership: json unmarshal error: %v", err)
 		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+		return nil, false
+	}
+	req.Email = strings.TrimSpace(req.Email)
+
+	if req.AccountId == "" || req.ArgonToken == "" {
+		http.Error(w, "Missing required field", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// authorizeMembershipRequest validates the request's Argon token. It writes the
+// error response on failure.
+func authorizeMembershipRequest(ctx context.Context, w http.ResponseWriter, db *sql.DB, req *MembershipRequest, audit *auditEvent) bool {
+	logger := log.FromContext(ctx)
+	ok, verr := ValidateArgonToken(ctx, db, req.AccountId, req.ArgonToken)
+	if verr != nil {
+		logger.Error("membership: token validation error for %s: %v", req.AccountId, verr)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		logger.Warn("membership: token invalid for %s", req.AccountId)
+		audit.Result = "denied"
+		http.Error(w, "Invalid Argon Token", http.StatusForbidden)
+		return false
 	}
+	return true
+}
 
-	if req.AccountId == "" || req.ArgonToken == "" || req.Email == "" {
+func membershipHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeMembershipRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Email == "" {
 		http.Error(w, "Missing required field", http.StatusBadRequest)
 		return
 	}
+	logger = logger.With("account_id", req.AccountId)
+
+	action := "membership_link"
+	if req.Code == "" {
+		action = "membership_code"
+	}
+	audit := newAuditEvent(r, action, req.AccountId)
+	defer audit.record()
+
+	notifier := verificationNotifier(cfg())
+	if notifier == nil {
+		logger.Warn("membership: linking requested but VERIFICATION_NOTIFIER is off")
+		audit.Result = "disabled"
+		http.Error(w, "Membership linking is not available", http.StatusServiceUnavailable)
+		return
+	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
 
 	db := DB
 	if db == nil {
-		log.Error("membership: DB not initialized")
+		logger.Error("membership: DB not initialized")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	var err error
 
-	if err := ensureMembershipsTable(ctx, db); err != nil {
-		log.Error("membership: table migration error: %v", err)
+	if !authorizeMembershipRequest(ctx, w, db, req, audit) {
+		return
+	}
+
+	if req.Code == "" {
+		requestVerificationCode(ctx, w, r, db, notifier, req, audit)
+		return
+	}
+
+	err := linkVerifiedMembership(ctx, db, req.AccountId, req.Email, req.Code)
+	var cooldown *cooldownError
+	switch {
+	case errors.Is(err, errVerificationFailed):
+		logger.Warn("membership: verification failed for %s", req.AccountId)
+		audit.Result = "denied"
+		http.Error(w, "Invalid or expired verification code", http.StatusForbidden)
+		return
+	case errors.Is(err, errMembershipLinked):
+		// The caller proved they own the email, so this is no longer a leak
+		logger.Warn("membership: email %s is already linked to another account", req.Email)
+		audit.Result = "conflict"
+		http.Error(w, "Email already registered to another account; unlink or transfer it from there", http.StatusConflict)
+		return
+	case errors.As(err, &cooldown):
+		logger.Warn("membership: %v", err)
+		audit.Result = "cooldown"
+		cooldown.write(w)
+		return
+	case err != nil:
+		logger.Error("membership: link error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Validate Argon
-	ok, verr := ValidateArgonToken(ctx, db, req.AccountId, req.ArgonToken)
-	if verr != nil {
-		log.Error("membership: token validation error for %s: %v", req.AccountId, verr)
+	logger.Info("membership: successfully applied membership for %s (email: %s)", req.AccountId, req.Email)
+	audit.Result = "ok"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("1"))
+}
+
+// requestVerificationCode stores a new code for the account and email and sends
+// it in the background if the email belongs to a membership, so neither the
+// response nor its timing tells whether it does.
+func requestVerificationCode(ctx context.Context, w http.ResponseWriter, r *http.Request, db *sql.DB, notifier Notifier, req *MembershipRequest, audit *auditEvent) {
+	logger := log.FromContext(ctx)
+
+	limited, err := rateLimited(ctx, db, req.AccountId, maxVerificationCodesPerHour, "membership_code")
+	if err != nil {
+		logger.Error("membership: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
-	if !ok {
-		log.Warn("membership: token invalid for %s", req.AccountId)
-		http.Error(w, "Invalid Argon Token", http.StatusForbidden)
+	if limited {
+		logger.Warn("membership: too many verification codes requested by %s", req.AccountId)
+		audit.Result = "rate_limited"
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Too many verification codes requested, try again later", http.StatusTooManyRequests)
 		return
 	}
 
-	var count int
-	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM memberships WHERE email = ?", req.Email).Scan(&count)
+	code, recipient, expiresAt, err := issueVerificationCode(ctx, db, req.AccountId, req.Email)
 	if err != nil {
-		log.Error("membership: email lookup error: %v", err)
+		logger.Error("membership: issue verification code error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if recipient != nil {
+		sendCtx := context.WithoutCancel(r.Context())
+		started := goBackground(func() {
+			sendCtx, cancel := context.WithTimeout(sendCtx, 30*time.Second)
+			defer cancel()
+			if err := notifier.SendVerificationCode(sendCtx, *recipient, code); err != nil {
+				logger.Error("membership: %s notifier failed for account %s: %v", notifier.Name(), req.AccountId, err)
+				return
+			}
+			logger.Info("membership: sent verification code for account %s via %s", req.AccountId, notifier.Name())
+		})
+		if !started {
+			// Same response as usual; the player can ask again once we're back
+			logger.Warn("membership: shutting down, verification code for account %s not sent", req.AccountId)
+		}
+	} else {
+		logger.Info("membership: no membership for %s, no code sent (account %s)", req.Email, req.AccountId)
+	}
 
-	if count == 0 {
-		// Email not found in memberships
-		log.Info("membership: email %s not found for account %s", req.Email, req.AccountId)
-		http.Error(w, "Email not found in memberships", http.StatusNotFound)
-		return
+	audit.Result = "ok"
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"message":   "If a membership uses this email, a verification code has been sent to its owner.",
+		"expiresAt": expiresAt.Format(time.RFC3339),
+	})
+}
+
+func newVerificationCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
 	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func hashVerificationCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
 
-	// Email found
-	log.Info("membership: found %d matches for email %s (account %s)", count, req.Email, req.AccountId)
+// issueVerificationCode replaces any pending code for the account and email with
+// a new one. The recipient is nil if no membership uses the email; the code is
+// stored anyway so confirming behaves the same.
+func issueVerificationCode(ctx context.Context, db *sql.DB, accountID, email string) (string, *verificationRecipient, time.Time, error) {
+	code, err := newVerificationCode()
+	if err != nil {
+		return "", nil, time.Time{}, err
+	}
+	expiresAt := time.Now().Add(cfg().VerificationCodeTTL)
 
-	// Check if email is already linked to an account
-	var existingLink string
-	err = db.QueryRowContext(ctx, "SELECT account_id FROM memberships WHERE email = ? AND account_id IS NOT NULL AND account_id != '' LIMIT 1", req.Email).Scan(&existingLink)
+	var found int
+	err = db.QueryRowContext(ctx, "SELECT 1 FROM memberships WHERE email = ? LIMIT 1", email).Scan(&found)
 	if err != nil && err != sql.ErrNoRows {
-		log.Error("membership: check link error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return "", nil, time.Time{}, fmt.Errorf("email lookup: %w", err)
 	}
+	var recipient *verificationRecipient
 	if err == nil {
-		// Found an existing link
-		log.Warn("membership: email %s already registered to account %s", req.Email, existingLink)
-		http.Error(w, "Email already registered", http.StatusConflict)
-		return
+		recipient = &verificationRecipient{AccountID: accountID, Email: email}
 	}
 
-	// Transaction to update both tables
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Error("membership: tx begin error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return "", nil, time.Time{}, err
 	}
 	defer tx.Rollback()
-
-	// 1. Link email to accountId in memberships table
-	if _, err := tx.ExecContext(ctx, "UPDATE memberships SET account_id = ? WHERE email = ?", req.AccountId, req.Email); err != nil {
-		log.Error("membership: failed to link memberships: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	if _, err := tx.ExecContext(ctx, "DELETE FROM membership_verifications WHERE (account_id = ? AND email = ?) OR expires_at < NOW()", accountID, email); err != nil {
+		return "", nil, time.Time{}, err
 	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO membership_verifications (account_id, email, code_hash, expires_at) VALUES (?, ?, ?, ?)", accountID, email, hashVerificationCode(code), expiresAt); err != nil {
+		return "", nil, time.Time{}, err
+	}
+	return code, recipient, expiresAt, tx.Commit()
+}
 
-	// 2. Check if any now-linked membership is valid (unexpired)
-	var validCount int
-	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM memberships WHERE account_id = ? AND (expires_at > NOW() OR expires_at IS NULL)", req.AccountId).Scan(&validCount)
+// linkVerifiedMembership checks code against the pending verification and, if
+// it matches, links the memberships using email to the account. Every guess
+// counts towards maxVerificationAttempts.
+func linkVerifiedMembership(ctx context.Context, db *sql.DB, accountID, email, code string) error {
+	var id int64
+	var codeHash string
+	err := db.QueryRowContext(ctx, "SELECT id, code_hash FROM membership_verifications WHERE account_id = ? AND email = ? AND expires_at > NOW() AND attempts < ? ORDER BY id DESC LIMIT 1",
+		accountID, email, maxVerificationAttempts).Scan(&id, &codeHash)
+	if err == sql.ErrNoRows {
+		return errVerificationFailed
+	}
 	if err != nil {
-		log.Error("membership: failed to check validity: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+		return fmt.Errorf("verification lookup: %w", err)
+	}
+	// Count the attempt before comparing so parallel guesses can't exceed the limit
+	res, err := db.ExecContext(ctx, "UPDATE membership_verifications SET attempts = attempts + 1 WHERE id = ? AND attempts < ?", id, maxVerificationAttempts)
+	if err != nil {
+		return fmt.Errorf("verification update: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errVerificationFailed
+	}
+	if subtle.ConstantTimeCompare([]byte(hashVerificationCode(code)), []byte(codeHash)) != 1 {
+		return errVerificationFailed
 	}
 
-	if validCount > 0 {
-		// Grant subscriber status
-		if _, err := tx.ExecContext(ctx, "UPDATE accounts SET subscriber = 1 WHERE account_id = ?", req.AccountId); err != nil {
-			log.Error("membership: failed to update account subscriber status: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
-		}
-		log.Info("membership: granted subscriber status to %s", req.AccountId)
-	} else {
-		log.Info("membership: linked memberships for %s but none are active/unexpired", req.AccountId)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
 
-	if err := tx.Commit(); err != nil {
-		log.Error("membership: tx commit error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	var linkedElsewhere int
+	err = tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM memberships WHERE email = ? AND account_id IS NOT NULL AND account_id != '' AND account_id != ? FOR UPDATE", email, accountID).Scan(&linkedElsewhere)
+	if err != nil {
+		return fmt.Errorf("check link: %w", err)
+	}
+	if linkedElsewhere > 0 {
+		return errMembershipLinked
+	}
+	// Unlinking and linking elsewhere counts as a transfer
+	var changedAt sql.NullTime
+	if err := tx.QueryRowContext(ctx, "SELECT MAX(account_changed_at) FROM memberships WHERE email = ? AND (account_id IS NULL OR account_id = '')", email).Scan(&changedAt); err != nil {
+		return fmt.Errorf("cooldown lookup: %w", err)
+	}
+	if err := checkTransferCooldown(changedAt); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE memberships SET account_changed_at = IF(account_id <=> ?, account_changed_at, NOW()), account_id = ? WHERE email = ?", accountID, accountID, email); err != nil {
+		return fmt.Errorf("link memberships: %w", err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM membership_verifications WHERE id = ?", id); err != nil {
+		return err
 	}
 
-	log.Info("membership: successfully applied membership for %s (email: %s)", req.AccountId, req.Email)
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("1"))
+	// Grant subscriber status if any now-linked membership is active
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET subscriber = 1 WHERE account_id = ? AND EXISTS (
+			SELECT 1 FROM memberships WHERE account_id = ? AND (expires_at > NOW() OR expires_at IS NULL)
+		)`, accountID, accountID); err != nil {
+		return fmt.Errorf("subscriber update: %w", err)
+	}
+	if err := updateQuotaState(ctx, tx, accountID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Minimal Prometheus text-format metrics. Kept dependency free on purpose.
+
+var defaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogramSeries{}}
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", n, v))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func splitKey(key string, n int) []string {
+	if n == 0 {
+		return nil
+	}
+	return strings.Split(key, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, splitKey(k, len(c.labels))), formatFloat(c.values[k]))
+	}
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		lv := splitKey(k, len(h.labels))
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, lv, "le", formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, lv, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, lv), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, lv), s.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func writeCounter(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+var (
+	httpRequestsTotal   = newCounterVec("gdaltweb_http_requests_total", "HTTP requests by route, method and status.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("gdaltweb_http_request_duration_seconds", "HTTP request latency by route and status.", defaultDurationBuckets, "route", "status")
+	httpBytesReceived   = newCounterVec("gdaltweb_http_request_bytes_total", "Bytes read from request bodies by route.", "route")
+	httpBytesSent       = newCounterVec("gdaltweb_http_response_bytes_total", "Bytes written to response bodies by route.", "route")
+
+	argonValidations = newCounterVec("gdaltweb_argon_validations_total", "Argon token validation outcomes (cached, success, invalid, rate_limited, error).", "result")
+
+	cleanupRuns        = newCounterVec("gdaltweb_cleanup_runs_total", "Completed cleanup runs.")
+	cleanupDuration    = newHistogramVec("gdaltweb_cleanup_duration_seconds", "Cleanup run duration.", defaultDurationBuckets)
+	cleanupRowsDeleted = newCounterVec("gdaltweb_cleanup_rows_deleted_total", "Rows removed or updated by cleanup, by kind.", "kind")
+
+	jobRuns     = newCounterVec("gdaltweb_job_runs_total", "Finished job runs by job and status (ok, error, timeout).", "job", "status")
+	jobDuration = newHistogramVec("gdaltweb_job_duration_seconds", "Job run duration by job.", defaultDurationBuckets, "job")
+)
+
+func init() {
+	http.HandleFunc("/metrics", metricsHandler)
+}
+
+// metricsRoute maps a request onto its registered pattern so that unknown paths
+// don't explode label cardinality.
+func metricsRoute(r *http.Request) string {
+	_, pattern := http.DefaultServeMux.Handler(r)
+	if pattern == "" || pattern == "/" {
+		return "other"
+	}
+	return pattern
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the wrapped writer so streamed responses aren't
+// buffered by the middleware.
+func (s *statusRecorder) Flush() {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer's other
+// optional interfaces.
+func (s *statusRecorder) Unwrap() http.ResponseWriter { return s.ResponseWriter }
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := metricsRoute(r)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequestsTotal.Inc(route, r.Method, status)
+		httpRequestDuration.Observe(time.Since(start).Seconds(), route, status)
+		httpBytesReceived.Add(float64(body.n), route)
+		httpBytesSent.Add(float64(rec.bytes), route)
+	})
+}
+
+// metricsAuthorized checks the bearer token of a scrape against METRICS_TOKEN,
+// or ADMIN_TOKEN if that is unset. It writes the error response on failure.
+func metricsAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	conf := cfg()
+	token := conf.MetricsToken
+	if token == "" {
+		token = conf.AdminToken
+	}
+	if token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	reqToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// dbMetricsTTL is how long values read from the database are reused between
+// scrapes, so frequent or parallel scrapes don't load the primary.
+const dbMetricsTTL = 30 * time.Second
+
+var dbMetrics struct {
+	mu          sync.Mutex
+	fetchedAt   time.Time
+	ok          bool
+	subscribers int64
+	leaseHolder string
+}
+
+// cachedDBMetrics returns the subscriber count and scheduler lease holder,
+// refreshing them once they are older than dbMetricsTTL. ok is false if they
+// have never been read successfully.
+func cachedDBMetrics(ctx context.Context, db *sql.DB) (subscribers int64, leaseHolder string, ok bool) {
+	dbMetrics.mu.Lock()
+	defer dbMetrics.mu.Unlock()
+	if time.Since(dbMetrics.fetchedAt) < dbMetricsTTL {
+		return dbMetrics.subscribers, dbMetrics.leaseHolder, dbMetrics.ok
+	}
+	// Failed lookups are retried after the TTL too, with stale values served meanwhile
+	dbMetrics.fetchedAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE subscriber = 1").Scan(&subscribers); err != nil {
+		log.Warn("metrics: subscriber count error: %v", err)
+		return dbMetrics.subscribers, dbMetrics.leaseHolder, dbMetrics.ok
+	}
+	leaseHolder, err := currentLeaseHolder(ctx, db, schedulerLeaseName)
+	if err != nil {
+		log.Warn("metrics: scheduler lease lookup error: %v", err)
+		return dbMetrics.subscribers, dbMetrics.leaseHolder, dbMetrics.ok
+	}
+	dbMetrics.subscribers, dbMetrics.leaseHolder, dbMetrics.ok = subscribers, leaseHolder, true
+	return subscribers, leaseHolder, true
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !metricsAuthorized(w, r) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+
+	httpRequestsTotal.writeTo(w)
+	httpRequestDuration.writeTo(w)
+	httpBytesReceived.writeTo(w)
+	httpBytesSent.writeTo(w)
+	argonValidations.writeTo(w)
+	cleanupRuns.writeTo(w)
+	cleanupDuration.writeTo(w)
+	cleanupRowsDeleted.writeTo(w)
+	jobRuns.writeTo(w)
+	jobDuration.writeTo(w)
+
+	leader := 0.0
+	if schedulerLease.isHeld() {
+		leader = 1
+	}
+	fmt.Fprintf(w, "# HELP gdaltweb_scheduler_leader Whether this instance holds the scheduler lease.\n# TYPE gdaltweb_scheduler_leader gauge\n")
+	fmt.Fprintf(w, "gdaltweb_scheduler_leader%s %s\n", formatLabels([]string{"instance"}, []string{instanceID()}), formatFloat(leader))
+
+	db := DB
+	if db == nil {
+		return
+	}
+
+	stats := db.Stats()
+	writeGauge(w, "gdaltweb_db_open_connections", "Established DB connections (in use + idle).", float64(stats.OpenConnections))
+	writeGauge(w, "gdaltweb_db_in_use_connections", "DB connections currently in use.", float64(stats.InUse))
+	writeGauge(w, "gdaltweb_db_idle_connections", "Idle DB connections.", float64(stats.Idle))
+	writeGauge(w, "gdaltweb_db_max_open_connections", "Configured maximum open DB connections.", float64(stats.MaxOpenConnections))
+	writeCounter(w, "gdaltweb_db_wait_count_total", "Total number of connections waited for.", float64(stats.WaitCount))
+	writeCounter(w, "gdaltweb_db_wait_duration_seconds_total", "Total time blocked waiting for a DB connection.", stats.WaitDuration.Seconds())
+	writeCounter(w, "gdaltweb_db_max_idle_closed_total", "Connections closed due to SetMaxIdleConns.", float64(stats.MaxIdleClosed))
+	writeCounter(w, "gdaltweb_db_max_lifetime_closed_total", "Connections closed due to SetConnMaxLifetime.", float64(stats.MaxLifetimeClosed))
+
+	subscribers, holder, ok := cachedDBMetrics(r.Context(), db)
+	if !ok {
+		return
+	}
+	writeGauge(w, "gdaltweb_active_subscribers", "Accounts with subscriber status.", float64(subscribers))
+	if holder != "" {
+		fmt.Fprintf(w, "# HELP gdaltweb_scheduler_lease_holder Instance currently holding the scheduler lease.\n# TYPE gdaltweb_scheduler_lease_holder gauge\n")
+		fmt.Fprintf(w, "gdaltweb_scheduler_lease_holder%s 1\n", formatLabels([]string{"instance"}, []string{holder}))
+	}
+}
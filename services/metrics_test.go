@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandlerAuth(t *testing.T) {
+	scrape := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		metricsHandler(rec, req)
+		return rec
+	}
+
+	withConfig(t, func(c *Config) { c.AdminToken, c.MetricsToken = "", "" })
+	if rec := scrape("anything"); rec.Code != http.StatusNotFound {
+		t.Errorf("without tokens: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+
+	withConfig(t, func(c *Config) { c.AdminToken = "admin" })
+	if rec := scrape(""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := scrape("admin"); rec.Code != http.StatusOK {
+		t.Errorf("admin token: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+
+	withConfig(t, func(c *Config) { c.MetricsToken = "scrape" })
+	if rec := scrape("admin"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("admin token with METRICS_TOKEN set: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	rec := scrape("scrape")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "# TYPE gdaltweb_http_requests_total counter") {
+		t.Errorf("metrics token: status = %d, body:\n%s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMetricsMiddlewareFlush(t *testing.T) {
+	handler := metricsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("Flush through the middleware: %v", err)
+		}
+		if _, ok := w.(interface{ Unwrap() http.ResponseWriter }); !ok {
+			t.Error("recorder doesn't unwrap")
+		}
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/check", nil))
+	if !rec.Flushed {
+		t.Error("response was not flushed")
+	}
+}
@@ -0,0 +1,2 @@
+-- The backfilled columns are part of the initial schema; nothing to undo.
+DO 0;
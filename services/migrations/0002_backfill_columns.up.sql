@@ -0,0 +1,27 @@
+-- Installs created before versioned migrations may be missing columns that were
+-- previously added ad hoc at runtime. Each column is only added if it's absent.
+
+SET @stmt = IF((SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'accounts' AND COLUMN_NAME = 'token_validated_at') = 0, 'ALTER TABLE accounts ADD COLUMN token_validated_at TIMESTAMP NULL', 'DO 0');
+PREPARE stmt FROM @stmt;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @stmt = IF((SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'accounts' AND COLUMN_NAME = 'subscriber') = 0, 'ALTER TABLE accounts ADD COLUMN subscriber BOOLEAN DEFAULT FALSE', 'DO 0');
+PREPARE stmt FROM @stmt;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @stmt = IF((SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'saves' AND COLUMN_NAME = 'level_data') = 0, 'ALTER TABLE saves ADD COLUMN level_data LONGTEXT NOT NULL', 'DO 0');
+PREPARE stmt FROM @stmt;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @stmt = IF((SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'memberships' AND COLUMN_NAME = 'account_id') = 0, 'ALTER TABLE memberships ADD COLUMN account_id VARCHAR(255)', 'DO 0');
+PREPARE stmt FROM @stmt;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
+
+SET @stmt = IF((SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'memberships' AND COLUMN_NAME = 'expires_at') = 0, 'ALTER TABLE memberships ADD COLUMN expires_at TIMESTAMP NULL', 'DO 0');
+PREPARE stmt FROM @stmt;
+EXECUTE stmt;
+DEALLOCATE PREPARE stmt;
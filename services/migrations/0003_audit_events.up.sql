@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    action VARCHAR(64) NOT NULL,
+    ip VARCHAR(64),
+    user_agent VARCHAR(255),
+    request_id VARCHAR(64),
+    bytes BIGINT NOT NULL DEFAULT 0,
+    result VARCHAR(32) NOT NULL,
+    detail VARCHAR(255),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_audit_account_created (account_id, created_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS cleanup_reports (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    started_at TIMESTAMP NULL,
+    finished_at TIMESTAMP NULL,
+    retention_days INT NOT NULL,
+    subscriber_retention_days INT NOT NULL,
+    accounts_removed INT NOT NULL DEFAULT 0,
+    bytes_reclaimed BIGINT NOT NULL DEFAULT 0,
+    subscribers_expired INT NOT NULL DEFAULT 0,
+    audit_events_pruned INT NOT NULL DEFAULT 0,
+    errors TEXT
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
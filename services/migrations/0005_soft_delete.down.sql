@@ -0,0 +1,8 @@
+-- Anything still in the trash is removed for good.
+DELETE FROM saves WHERE deleted_at IS NOT NULL;
+DELETE FROM accounts WHERE deleted_at IS NOT NULL;
+
+ALTER TABLE cleanup_reports DROP COLUMN backups_purged;
+ALTER TABLE accounts DROP COLUMN deleted_at;
+ALTER TABLE saves DROP INDEX idx_saves_deleted_at;
+ALTER TABLE saves DROP COLUMN deleted_at;
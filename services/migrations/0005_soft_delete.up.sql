@@ -0,0 +1,7 @@
+-- Deleted backups and cleaned-up accounts stay in the trash until the recovery
+-- window passes and the cleanup scheduler purges them.
+
+ALTER TABLE saves ADD COLUMN deleted_at TIMESTAMP NULL;
+ALTER TABLE saves ADD INDEX idx_saves_deleted_at (deleted_at);
+ALTER TABLE accounts ADD COLUMN deleted_at TIMESTAMP NULL;
+ALTER TABLE cleanup_reports ADD COLUMN backups_purged INT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE cleanup_reports DROP COLUMN accounts_warned;
+ALTER TABLE accounts DROP COLUMN expiry_notified_at;
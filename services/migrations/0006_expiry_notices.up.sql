@@ -0,0 +1,4 @@
+-- When an account was last warned that its backup is about to expire. A warning
+-- newer than the last save means it shouldn't be sent again.
+ALTER TABLE accounts ADD COLUMN expiry_notified_at TIMESTAMP NULL;
+ALTER TABLE cleanup_reports ADD COLUMN accounts_warned INT NOT NULL DEFAULT 0;
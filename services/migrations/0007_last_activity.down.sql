@@ -0,0 +1,3 @@
+ALTER TABLE cleanup_reports DROP COLUMN orphans_removed;
+ALTER TABLE accounts DROP INDEX idx_accounts_last_activity;
+ALTER TABLE accounts DROP COLUMN last_activity_at;
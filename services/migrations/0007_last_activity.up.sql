@@ -0,0 +1,14 @@
+-- Cleanup is driven by the last authenticated request instead of the save time.
+-- Existing accounts start from whichever of their last save or last token
+-- validation is newer.
+ALTER TABLE accounts ADD COLUMN last_activity_at TIMESTAMP NULL;
+ALTER TABLE accounts ADD INDEX idx_accounts_last_activity (last_activity_at);
+
+UPDATE accounts a
+LEFT JOIN saves s ON s.account_id = a.account_id
+SET a.last_activity_at = GREATEST(
+    COALESCE(s.created_at, a.token_validated_at, a.created_at),
+    COALESCE(a.token_validated_at, s.created_at, a.created_at)
+);
+
+ALTER TABLE cleanup_reports ADD COLUMN orphans_removed INT NOT NULL DEFAULT 0;
@@ -0,0 +1,2 @@
+ALTER TABLE cleanup_reports DROP COLUMN phases;
+DROP TABLE IF EXISTS job_runs;
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS job_runs (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    job_name VARCHAR(64) NOT NULL,
+    instance VARCHAR(255) NOT NULL,
+    trigger_source VARCHAR(16) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    message TEXT,
+    started_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL,
+    KEY idx_job_runs_job (job_name, id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+ALTER TABLE cleanup_reports ADD COLUMN phases VARCHAR(255) NOT NULL DEFAULT '';
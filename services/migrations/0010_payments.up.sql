@@ -0,0 +1,26 @@
+-- Every payment is recorded once, keyed by the provider's transaction ID, and
+-- membership expiry is derived from these rows.
+
+CREATE TABLE IF NOT EXISTS payments (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    transaction_id VARCHAR(255) NOT NULL,
+    membership_id INT NOT NULL,
+    type VARCHAR(32) NOT NULL DEFAULT '',
+    tier_name VARCHAR(255),
+    amount VARCHAR(32) NOT NULL DEFAULT '',
+    currency VARCHAR(8) NOT NULL DEFAULT '',
+    months INT NOT NULL DEFAULT 0,
+    days INT NOT NULL DEFAULT 0,
+    paid_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    starts_at TIMESTAMP NULL,
+    ends_at TIMESTAMP NULL,
+    UNIQUE KEY unique_transaction (transaction_id),
+    KEY idx_payments_membership (membership_id, paid_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Existing memberships get one entry without a period that covers their
+-- current expiry, so recomputing from the ledger keeps it.
+INSERT IGNORE INTO payments (transaction_id, membership_id, type, tier_name, paid_at, starts_at, ends_at)
+SELECT COALESCE(NULLIF(kofi_transaction_id, ''), CONCAT('legacy-', id)), id, 'Legacy', tier_name,
+    LEAST(created_at, expires_at), LEAST(created_at, expires_at), expires_at
+FROM memberships WHERE expires_at IS NOT NULL;
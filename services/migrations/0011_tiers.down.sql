@@ -0,0 +1,3 @@
+ALTER TABLE memberships DROP FOREIGN KEY fk_memberships_tier;
+ALTER TABLE memberships DROP INDEX fk_memberships_tier;
+DROP TABLE IF EXISTS tiers;
@@ -0,0 +1,16 @@
+-- Membership tiers and their limits. NULL limits fall back to the config
+-- defaults for free or subscriber accounts; NULL rate limits are unlimited.
+
+CREATE TABLE IF NOT EXISTS tiers (
+    name VARCHAR(255) PRIMARY KEY,
+    max_data_size_bytes BIGINT NULL,
+    retention_days INT NULL,
+    saves_per_hour INT NULL,
+    loads_per_hour INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO tiers (name) VALUES ('Free'), ('Account Backup Extra');
+UPDATE memberships SET tier_name = 'Account Backup Extra' WHERE tier_name IS NULL OR tier_name = '';
+INSERT IGNORE INTO tiers (name) SELECT DISTINCT tier_name FROM memberships;
+ALTER TABLE memberships ADD CONSTRAINT fk_memberships_tier FOREIGN KEY (tier_name) REFERENCES tiers (name) ON UPDATE CASCADE;
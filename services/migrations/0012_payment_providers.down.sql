@@ -0,0 +1,3 @@
+UPDATE payments SET transaction_id = CONCAT('manual-', transaction_id) WHERE provider = 'manual';
+ALTER TABLE payments DROP INDEX unique_transaction, ADD UNIQUE KEY unique_transaction (transaction_id);
+ALTER TABLE payments DROP COLUMN provider;
@@ -0,0 +1,5 @@
+-- Transaction IDs are only unique per payment provider.
+
+ALTER TABLE payments ADD COLUMN provider VARCHAR(32) NOT NULL DEFAULT 'kofi' AFTER id;
+UPDATE payments SET provider = 'manual', transaction_id = SUBSTRING(transaction_id, 8) WHERE type = 'Manual' AND transaction_id LIKE 'manual-%';
+ALTER TABLE payments DROP INDEX unique_transaction, ADD UNIQUE KEY unique_transaction (provider, transaction_id);
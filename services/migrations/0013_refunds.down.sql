@@ -0,0 +1,4 @@
+ALTER TABLE accounts DROP COLUMN over_quota_since;
+DELETE FROM payments WHERE cancellation = TRUE;
+ALTER TABLE payments DROP COLUMN cancellation;
+ALTER TABLE payments DROP COLUMN refunded_at;
@@ -0,0 +1,7 @@
+-- Refunded payments stay in the ledger but no longer count, cancellations end
+-- a membership at the time they were recorded, and accounts left storing more
+-- than their tier allows are flagged.
+
+ALTER TABLE payments ADD COLUMN refunded_at TIMESTAMP NULL;
+ALTER TABLE payments ADD COLUMN cancellation BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE accounts ADD COLUMN over_quota_since TIMESTAMP NULL;
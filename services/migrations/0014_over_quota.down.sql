@@ -0,0 +1,4 @@
+DROP INDEX idx_accounts_over_quota ON accounts;
+ALTER TABLE cleanup_reports DROP COLUMN over_quota_bytes_trimmed;
+ALTER TABLE cleanup_reports DROP COLUMN over_quota_trimmed;
+ALTER TABLE cleanup_reports DROP COLUMN over_quota_marked;
@@ -0,0 +1,7 @@
+-- Over-quota accounts are flagged by the subscriber-expiry job and trimmed by
+-- the over-quota-trim job once the grace period is over.
+
+ALTER TABLE cleanup_reports ADD COLUMN over_quota_marked INT NOT NULL DEFAULT 0;
+ALTER TABLE cleanup_reports ADD COLUMN over_quota_trimmed INT NOT NULL DEFAULT 0;
+ALTER TABLE cleanup_reports ADD COLUMN over_quota_bytes_trimmed BIGINT NOT NULL DEFAULT 0;
+CREATE INDEX idx_accounts_over_quota ON accounts (over_quota_since);
@@ -0,0 +1,14 @@
+-- Pending email verifications for linking a membership to an account. Only a
+-- hash of the code is stored.
+
+CREATE TABLE IF NOT EXISTS membership_verifications (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    account_id VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    INDEX idx_verifications_account (account_id, email),
+    INDEX idx_verifications_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
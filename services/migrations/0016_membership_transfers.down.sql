@@ -0,0 +1 @@
+ALTER TABLE memberships DROP COLUMN account_changed_at;
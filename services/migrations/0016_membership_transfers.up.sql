@@ -0,0 +1,4 @@
+-- When a membership was last linked or transferred to an account, for the
+-- transfer cooldown. NULL for links made before this migration.
+
+ALTER TABLE memberships ADD COLUMN account_changed_at TIMESTAMP NULL;
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Membership verification codes are delivered by the notifier selected with
+// VERIFICATION_NOTIFIER:
+//
+//	smtp  email the code to the membership's address through SMTP_HOST (default)
+//	log   write it to the server log, for local testing only
+//	off   don't send codes; linking memberships is disabled
+//
+// smtp is the default so that a server without SMTP settings fails to start
+// instead of quietly refusing every link request. Codes are
+// never posted to shared channels such as Discord webhooks, where anyone who can
+// read the channel could use another supporter's code.
+
+// Notifier delivers membership verification codes.
+type Notifier interface {
+	// Name identifies the notifier in logs.
+	Name() string
+	// SendVerificationCode delivers code to the owner of a membership.
+	SendVerificationCode(ctx context.Context, to verificationRecipient, code string) error
+}
+
+// verificationRecipient is the membership a code was requested for.
+type verificationRecipient struct {
+	AccountID string
+	Email     string
+}
+
+const (
+	notifierSMTP = "smtp"
+	notifierLog  = "log"
+	notifierOff  = "off"
+)
+
+// verificationNotifier returns the notifier configured in c, or nil if linking
+// is disabled.
+func verificationNotifier(c *Config) Notifier {
+	switch c.VerificationNotifier {
+	case notifierSMTP:
+		return smtpNotifier{
+			addr:     net.JoinHostPort(c.SMTPHost, strconv.Itoa(c.SMTPPort)),
+			host:     c.SMTPHost,
+			username: c.SMTPUsername,
+			password: c.SMTPPassword,
+			from:     c.SMTPFrom,
+		}
+	case notifierLog:
+		return logNotifier{}
+	}
+	return nil
+}
+
+func verificationMessage(code string) string {
+	return fmt.Sprintf("Your Geometry Dash backup membership verification code is %s. It expires in %d minutes. If you didn't ask for it, ignore this message.",
+		code, int(cfg().VerificationCodeTTL.Minutes()))
+}
+
+// smtpNotifier emails codes. Authentication is skipped when no username is set;
+// net/smtp upgrades to TLS when the server offers STARTTLS.
+type smtpNotifier struct {
+	addr     string
+	host     string
+	username string
+	password string
+	from     string
+}
+
+func (smtpNotifier) Name() string { return notifierSMTP }
+
+func (n smtpNotifier) SendVerificationCode(ctx context.Context, to verificationRecipient, code string) error {
+	if strings.ContainsAny(to.Email, "\r\n") {
+		return fmt.Errorf("invalid recipient address")
+	}
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+	msg := "From: " + n.from + "\r\n" +
+		"To: " + to.Email + "\r\n" +
+		"Subject: Your verification code\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + verificationMessage(code) + "\r\n"
+
+	// smtp.SendMail has no context; run it aside so ctx still bounds the wait
+	done := make(chan error, 1)
+	go func() { done <- smtp.SendMail(n.addr, auth, n.from, []string{to.Email}, []byte(msg)) }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logNotifier writes codes to the log.
+type logNotifier struct{}
+
+func (logNotifier) Name() string { return notifierLog }
+
+func (logNotifier) SendVerificationCode(ctx context.Context, to verificationRecipient, code string) error {
+	log.FromContext(ctx).Warn("membership: verification code for %s (account %s) is %s", to.Email, to.AccountID, code)
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// smtpStub accepts one SMTP session on a local port and sends the message data
+// to the returned channel.
+func smtpStub(t *testing.T) (host string, port int, messages <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	out := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 localhost stub")
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					l, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if l == ".\r\n" {
+						break
+					}
+					data.WriteString(l)
+				}
+				out <- data.String()
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, out
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	host, port, messages := smtpStub(t)
+	n := verificationNotifier(&Config{VerificationNotifier: notifierSMTP, SMTPHost: host, SMTPPort: port, SMTPFrom: "backups@example.com"})
+	if n == nil || n.Name() != notifierSMTP {
+		t.Fatalf("notifier = %v", n)
+	}
+
+	to := verificationRecipient{AccountID: "123", Email: "player@example.com"}
+	if err := n.SendVerificationCode(context.Background(), to, "042137"); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-messages
+	if !strings.Contains(msg, "To: player@example.com") || !strings.Contains(msg, "042137") {
+		t.Errorf("unexpected message:\n%s", msg)
+	}
+
+	to.Email = "player@example.com\r\nBcc: someone@example.com"
+	if err := n.SendVerificationCode(context.Background(), to, "042137"); err == nil {
+		t.Error("header injection in the recipient was accepted")
+	}
+}
+
+func TestVerificationNotifierDisabled(t *testing.T) {
+	if n := verificationNotifier(&Config{VerificationNotifier: notifierOff}); n != nil {
+		t.Errorf("notifier = %v, want nil", n)
+	}
+}
+
+func TestVerificationNotifierRequiresSMTP(t *testing.T) {
+	c := defaultConfig()
+	c.DBUser, c.DBHost, c.DBName = "user", "localhost", "backups"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "SMTP_HOST") {
+		t.Errorf("Validate() = %v, want an error about SMTP_HOST", err)
+	}
+	c.VerificationNotifier = notifierOff
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() with the notifier off = %v", err)
+	}
+}
+
+func TestNewVerificationCode(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		code, err := newVerificationCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := strconv.Atoi(code); err != nil || len(code) != 6 {
+			t.Fatalf("code = %q, want 6 digits", code)
+		}
+	}
+	if hashVerificationCode("000001") == hashVerificationCode("000002") {
+		t.Error("different codes hash the same")
+	}
+}
+
+func TestMembershipHandlerDisabled(t *testing.T) {
+	withConfig(t, func(c *Config) { c.VerificationNotifier = notifierOff })
+	rec := httptest.NewRecorder()
+	body := `{"accountId":"123","argonToken":"token","email":"player@example.com"}`
+	membershipHandler(rec, httptest.NewRequest(http.MethodPost, "/membership", strings.NewReader(body)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// expiryNotice is posted to EXPIRY_WEBHOOK_URL for each account whose backup is
+// about to be removed by the cleanup. Content makes the payload usable as-is
+// with a Discord webhook.
+type expiryNotice struct {
+	Content       string    `json:"content"`
+	AccountID     string    `json:"accountId"`
+	DiscordUserID string    `json:"discordUserId,omitempty"`
+	Subscriber    bool      `json:"subscriber"`
+	Tier          string    `json:"tier"`
+	LastActivity  time.Time `json:"lastActivity"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	ExpiresInDays int       `json:"expiresInDays"`
+}
+
+type expiringAccount struct {
+	AccountID     string
+	DiscordUserID string
+	Tier          string
+	RetentionDays int
+	LastActivity  time.Time
+}
+
+// daysUntil rounds up so a backup expiring later today reports 1 day, not 0.
+func daysUntil(t time.Time) int {
+	d := time.Until(t)
+	if d <= 0 {
+		return 0
+	}
+	return int((d + 24*time.Hour - 1) / (24 * time.Hour))
+}
+
+// findExpiringAccounts returns accounts with a backup that will expire within
+// EXPIRY_WARNING_DAYS under their tier's retention and that haven't been warned
+// since they were last active.
+func findExpiringAccounts(ctx context.Context, db *sql.DB) ([]expiringAccount, error) {
+	conf := cfg()
+	query := `SELECT x.account_id, x.tier_name, ` + tierRetentionSQL + `, x.last_activity, x.discord_userid
+				FROM (
+					SELECT a.account_id, COALESCE(a.last_activity_at, a.created_at) AS last_activity, a.expiry_notified_at,
+						` + accountTierNameSQL + ` AS tier_name,
+						(SELECT m.discord_userid FROM memberships m WHERE m.account_id = a.account_id AND m.discord_userid IS NOT NULL AND m.discord_userid != '' ORDER BY m.id DESC LIMIT 1) AS discord_userid
+					FROM accounts a
+					JOIN saves s ON a.account_id = s.account_id
+					WHERE s.deleted_at IS NULL AND a.deleted_at IS NULL
+				) x
+				LEFT JOIN tiers t ON t.name = x.tier_name
+				WHERE (x.expiry_notified_at IS NULL OR x.expiry_notified_at < x.last_activity)
+				  AND ` + tierRetentionSQL + ` > 0
+				  AND x.last_activity < DATE_SUB(NOW(), INTERVAL GREATEST(` + tierRetentionSQL + ` - ?, 0) DAY)`
+	args := append(conf.tierRetentionArgs(), conf.tierRetentionArgs()...)
+	args = append(args, conf.tierRetentionArgs()...)
+	rows, err := db.QueryContext(ctx, query, append(args, conf.ExpiryWarningDays)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []expiringAccount
+	for rows.Next() {
+		var a expiringAccount
+		var discord sql.NullString
+		if err := rows.Scan(&a.AccountID, &a.Tier, &a.RetentionDays, &a.LastActivity, &discord); err != nil {
+			return nil, err
+		}
+		a.DiscordUserID = discord.String
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// notifyExpiringAccounts warns accounts approaching expiry. Without a webhook
+// configured the accounts are only flagged in the log and the report. It
+// returns how many accounts were (or, with dryRun, would be) warned.
+func notifyExpiringAccounts(ctx context.Context, dryRun bool) (int, error) {
+	conf := cfg()
+	if conf.ExpiryWarningDays <= 0 {
+		return 0, nil
+	}
+	accounts, err := findExpiringAccounts(ctx, DB)
+	if err != nil || dryRun {
+		return len(accounts), err
+	}
+
+	warned := 0
+	for _, a := range accounts {
+		expiresAt := a.LastActivity.AddDate(0, 0, a.RetentionDays)
+		if conf.ExpiryWebhookURL == "" {
+			log.Info("cleanup: backup of %s expires %s", a.AccountID, expiresAt.Format(time.RFC3339))
+		} else if err := sendExpiryNotice(ctx, conf.ExpiryWebhookURL, a, expiresAt); err != nil {
+			// Not marked, so it is retried on the next run
+			log.Warn("cleanup: expiry notice for %s failed: %v", a.AccountID, err)
+			continue
+		}
+		if _, err := DB.ExecContext(ctx, "UPDATE accounts SET expiry_notified_at = CURRENT_TIMESTAMP WHERE account_id = ?", a.AccountID); err != nil {
+			return warned, err
+		}
+		warned++
+	}
+	return warned, nil
+}
+
+func sendExpiryNotice(ctx context.Context, url string, a expiringAccount, expiresAt time.Time) error {
+	notice := expiryNotice{
+		AccountID:     a.AccountID,
+		DiscordUserID: a.DiscordUserID,
+		Subscriber:    a.Tier != freeTierName,
+		Tier:          a.Tier,
+		LastActivity:  a.LastActivity,
+		ExpiresAt:     expiresAt,
+		ExpiresInDays: daysUntil(expiresAt),
+	}
+	mention := "Account " + a.AccountID
+	if a.DiscordUserID != "" {
+		mention = fmt.Sprintf("<@%s> (account %s)", a.DiscordUserID, a.AccountID)
+	}
+	notice.Content = fmt.Sprintf("%s: your backup hasn't been used since %s and will be deleted in %d day(s). Log in to keep it.",
+		mention, a.LastActivity.Format("2006-01-02"), notice.ExpiresInDays)
+
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,135 +1,432 @@
-// If you are self-hosting, don't use this endpoint as this is mainly used for the main server.
+// If you are self-hosting, don't use the Ko-fi endpoint as it is mainly used for
+// the main server; see webhook.go to connect your own billing instead.
 
 package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// PaymentRequest is a Ko-fi webhook payload. Ko-fi POSTs it as the JSON value
+// of the "data" field of an application/x-www-form-urlencoded body; a plain JSON
+// body is accepted too.
 type PaymentRequest struct {
-	Type              string `json:"type"`
-	VerificationToken string `json:"verificationToken"`
-	Email             string `json:"email"`
-	DiscordUsername   string `json:"discord_username"`
-	DiscordUserID     string `json:"discord_userid"`
-	KofiTransactionID string `json:"kofi_transaction_id"`
+	VerificationToken          string `json:"verification_token"`
+	MessageID                  string `json:"message_id"`
+	Timestamp                  string `json:"timestamp"`
+	Type                       string `json:"type"`
+	IsPublic                   bool   `json:"is_public"`
+	FromName                   string `json:"from_name"`
+	Message                    string `json:"message"`
+	Amount                     string `json:"amount"`
+	URL                        string `json:"url"`
+	Email                      string `json:"email"`
+	Currency                   string `json:"currency"`
+	IsSubscriptionPayment      bool   `json:"is_subscription_payment"`
+	IsFirstSubscriptionPayment bool   `json:"is_first_subscription_payment"`
+	KofiTransactionID          string `json:"kofi_transaction_id"`
+	TierName                   string `json:"tier_name"`
+	DiscordUsername            string `json:"discord_username"`
+	DiscordUserID              string `json:"discord_userid"`
 }
 
-func init() {
-	http.HandleFunc("/payment", paymentHandler)
+func (p *PaymentRequest) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	get := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := raw[k]; ok && v != nil {
+				switch t := v.(type) {
+				case string:
+					return t
+				case float64:
+					return strconv.FormatFloat(t, 'f', -1, 64)
+				default:
+					return fmt.Sprintf("%v", t)
+				}
+			}
+		}
+		return ""
+	}
+	getBool := func(keys ...string) bool {
+		b, _ := strconv.ParseBool(get(keys...))
+		return b
+	}
+	p.VerificationToken = get("verification_token", "verificationToken")
+	p.MessageID = get("message_id", "messageId")
+	p.Timestamp = get("timestamp")
+	p.Type = get("type")
+	p.IsPublic = getBool("is_public", "isPublic")
+	p.FromName = get("from_name", "fromName")
+	p.Message = get("message")
+	p.Amount = get("amount")
+	p.URL = get("url")
+	p.Email = get("email")
+	p.Currency = get("currency")
+	p.IsSubscriptionPayment = getBool("is_subscription_payment", "isSubscriptionPayment")
+	p.IsFirstSubscriptionPayment = getBool("is_first_subscription_payment", "isFirstSubscriptionPayment")
+	p.KofiTransactionID = get("kofi_transaction_id", "kofiTransactionId")
+	p.TierName = get("tier_name", "tierName")
+	p.DiscordUsername = get("discord_username", "discordUsername")
+	p.DiscordUserID = get("discord_userid", "discordUserId")
+	return nil
 }
 
-func paymentHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		log.Warn("payment: invalid method %s", r.Method)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+// paidAt returns when the payment was made according to Ko-fi, so retries and
+// late deliveries count from the original payment. It falls back to now.
+func (p *PaymentRequest) paidAt() time.Time {
+	now := time.Now()
+	t, err := time.Parse(time.RFC3339, p.Timestamp)
+	if err != nil || t.After(now) {
+		return now
 	}
+	return t
+}
 
-	body, readErr := io.ReadAll(r.Body)
-	if readErr != nil {
-		log.Warn("payment: read body error: %v", readErr)
-		http.Error(w, "Failed to read request", http.StatusBadRequest)
-		return
+// defaultTierName is used for payments that don't name a Ko-fi tier, such as
+// one-off donations.
+const defaultTierName = "Account Backup Extra"
+
+// tier returns the membership tier the payment is for.
+func (p *PaymentRequest) tier() string {
+	if t := strings.TrimSpace(p.TierName); t != "" {
+		return t
 	}
+	return defaultTierName
+}
 
+var errMissingKofiData = errors.New("missing data field")
+
+// parsePaymentRequest decodes a Ko-fi webhook body according to its content type.
+func parsePaymentRequest(contentType string, body []byte) (*PaymentRequest, error) {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		data := form.Get("data")
+		if data == "" {
+			return nil, errMissingKofiData
+		}
+		body = []byte(data)
+	}
 	var req PaymentRequest
 	if err := json.Unmarshal(body, &req); err != nil {
-		log.Warn("payment: json unmarshal error: %v", err)
-		http.Error(w, "Invalid request", http.StatusBadRequest)
-		return
+		return nil, err
 	}
+	return &req, nil
+}
 
-	// Validate Verification Token
-	envToken := os.Getenv("VERIFICATION_TOKEN")
-	if envToken == "" {
-		log.Warn("payment: missing verification token")
-		http.Error(w, "Missing verification token", http.StatusForbidden)
-		return
+// verifyPaymentToken compares the payload's token with VERIFICATION_TOKEN in
+// constant time. It fails if no token is configured.
+func verifyPaymentToken(expected, got string) bool {
+	if expected == "" {
+		return false
 	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(got)) == 1
+}
 
-	if req.VerificationToken != envToken {
-		log.Warn("payment: invalid verification token for %s", req.Email)
-		http.Error(w, "Invalid verification token", http.StatusForbidden)
-		return
-	}
+// PaymentProvider turns a verified webhook delivery into a payment. Each
+// provider gets its own endpoint; all of them feed processMembership.
+type PaymentProvider interface {
+	// Name identifies the provider in logs and the payments ledger.
+	Name() string
+	// ParseWebhook verifies the request and returns the payment it describes.
+	// Errors should be webhookErrors so the caller can pick a status code.
+	ParseWebhook(r *http.Request, body []byte) (*paymentEvent, error)
+}
 
-	if req.KofiTransactionID == "" {
-		log.Warn("payment: missing kofi_transaction_id")
-	}
+// paymentEvent is a verified payment in provider-neutral form. A refund names
+// the transaction it refunds; a cancellation ends the membership for Email.
+type paymentEvent struct {
+	Provider        string
+	TransactionID   string
+	Type            string
+	Email           string
+	Amount          string
+	Currency        string
+	Tier            string
+	Months          int
+	Days            int
+	Refund          bool
+	Cancel          bool
+	PaidAt          time.Time
+	DiscordUsername string
+	DiscordUserID   string
+}
+
+// webhookError is a rejected delivery: Status and Message are sent back to the
+// provider, Err is logged.
+type webhookError struct {
+	Status  int
+	Message string
+	Err     error
+}
 
-	log.Info("payment: received transaction %s type=%s user='%s'", req.KofiTransactionID, req.Type, req.DiscordUsername)
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
 
-	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
-	defer cancel()
+func (e *webhookError) Unwrap() error { return e.Err }
 
-	if err := processMembership(ctx, req); err != nil {
-		log.Error("payment: failed to process membership: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-	log.Done("payment: processed membership for %s", req.DiscordUsername)
+func invalidPayload(err error) error {
+	return &webhookError{Status: http.StatusBadRequest, Message: "Invalid request", Err: err}
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+func verificationFailed(message string, err error) error {
+	return &webhookError{Status: http.StatusForbidden, Message: message, Err: err}
 }
 
-func processMembership(ctx context.Context, req PaymentRequest) error {
-	db := DB
-	if db == nil {
-		return fmt.Errorf("db open error: DB not initialized")
+// kofiProvider accepts Ko-fi webhooks. Every Ko-fi payment buys one month.
+type kofiProvider struct{}
+
+func (kofiProvider) Name() string { return "kofi" }
+
+func (kofiProvider) ParseWebhook(r *http.Request, body []byte) (*paymentEvent, error) {
+	req, err := parsePaymentRequest(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		return nil, invalidPayload(err)
 	}
-	var err error
 
-	var existingID int64
-	var currentExpires sql.NullTime
-	var existingAccountID sql.NullString
+	// Validate Verification Token
+	envToken := cfg().VerificationToken
+	if envToken == "" {
+		return nil, verificationFailed("Missing verification token", errors.New("VERIFICATION_TOKEN is not set"))
+	}
+	if !verifyPaymentToken(envToken, req.VerificationToken) {
+		return nil, verificationFailed("Invalid verification token", fmt.Errorf("invalid verification token for %s", req.Email))
+	}
 
-	err = db.QueryRowContext(ctx, "SELECT id, expires_at, account_id FROM memberships WHERE email = ? ORDER BY id DESC LIMIT 1", req.Email).Scan(&existingID, &currentExpires, &existingAccountID)
-	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("lookup error: %v", err)
+	// The transaction ID is what makes retried webhooks safe to process
+	if req.KofiTransactionID == "" {
+		return nil, &webhookError{Status: http.StatusBadRequest, Message: "Missing transaction ID", Err: errors.New("missing kofi_transaction_id")}
 	}
 
-	if err == nil {
-		start := time.Now()
-		if currentExpires.Valid && currentExpires.Time.After(start) {
-			start = currentExpires.Time
+	log.FromContext(r.Context()).Debug("payment: Ko-fi %s subscription=%v first=%v", req.Type, req.IsSubscriptionPayment, req.IsFirstSubscriptionPayment)
+	return &paymentEvent{
+		TransactionID:   req.KofiTransactionID,
+		Type:            req.Type,
+		Email:           req.Email,
+		Amount:          req.Amount,
+		Currency:        req.Currency,
+		Tier:            req.tier(),
+		Months:          1,
+		PaidAt:          req.paidAt(),
+		DiscordUsername: req.DiscordUsername,
+		DiscordUserID:   req.DiscordUserID,
+	}, nil
+}
+
+var paymentHandler = paymentWebhookHandler(kofiProvider{})
+
+func init() {
+	http.HandleFunc("/payment", paymentHandler)
+	http.HandleFunc("/payment/webhook", paymentWebhookHandler(signedWebhookProvider{}))
+}
+
+// paymentWebhookHandler serves the webhook endpoint of a payment provider.
+func paymentWebhookHandler(provider PaymentProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := log.FromContext(r.Context()).With("provider", provider.Name())
+		if r.Method != http.MethodPost {
+			logger.Warn("payment: invalid method %s", r.Method)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
 		}
-		newExpiry := start.AddDate(0, 1, 0) // Add 1 month
 
-		log.Info("payment: updating membership %d for %s (new expiry: %v)", existingID, req.Email, newExpiry)
-		_, err = db.ExecContext(ctx, "UPDATE memberships SET expires_at = ?, kofi_transaction_id = ? WHERE id = ?", newExpiry, req.KofiTransactionID, existingID)
-		if err != nil {
-			return fmt.Errorf("update error: %v", err)
+		body, readErr := io.ReadAll(r.Body)
+		if readErr != nil {
+			logger.Warn("payment: read body error: %v", readErr)
+			http.Error(w, "Failed to read request", http.StatusBadRequest)
+			return
 		}
 
-		// Update subscriber status if account is linked
-		if existingAccountID.Valid && existingAccountID.String != "" {
-			if _, err := db.ExecContext(ctx, "UPDATE accounts SET subscriber = 1 WHERE account_id = ?", existingAccountID.String); err != nil {
-				log.Warn("payment: failed to re-enable subscriber status for %s: %v", existingAccountID.String, err)
+		ev, err := provider.ParseWebhook(r, body)
+		if err != nil {
+			var werr *webhookError
+			if !errors.As(err, &werr) {
+				werr = &webhookError{Status: http.StatusBadRequest, Message: "Invalid request", Err: err}
 			}
+			logger.Warn("payment: rejected webhook: %v", err)
+			http.Error(w, werr.Message, werr.Status)
+			return
 		}
+		ev.Provider = provider.Name()
 
-	} else {
-		newExpiry := time.Now().AddDate(0, 1, 0)
-		log.Info("payment: creating new membership for %s (expiry: %v)", req.Email, newExpiry)
-		insertStmt := `INSERT INTO memberships (kofi_transaction_id, email, discord_username, discord_userid, tier_name, expires_at) VALUES (?, ?, ?, ?, ?, ?)`
+		logger.Info("payment: received transaction %s type=%s tier='%s' amount=%s %s period=%dm%dd refund=%v cancel=%v user='%s'",
+			ev.TransactionID, ev.Type, ev.Tier, ev.Amount, ev.Currency, ev.Months, ev.Days, ev.Refund, ev.Cancel, ev.DiscordUsername)
 
-		_, err = db.ExecContext(ctx, insertStmt, req.KofiTransactionID, req.Email, req.DiscordUsername, req.DiscordUserID, "Account Backup Extra", newExpiry)
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		// Payments only show up in an account's audit trail once the email is linked
+		audit := newAuditEvent(r, "payment", "")
+		audit.Detail = ev.Provider + ":" + ev.TransactionID
+		defer audit.record()
+
+		db := DB
+		if db == nil {
+			logger.Error("payment: DB not initialized")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		var linkedAccount string
+		switch {
+		case ev.Refund:
+			audit.Action = "payment_refund"
+			linkedAccount, err = refundPayment(ctx, db, ev.Provider, ev.TransactionID)
+		case ev.Cancel:
+			audit.Action = "payment_cancel"
+			linkedAccount, err = cancelMembership(ctx, db, ev)
+		default:
+			linkedAccount, err = processMembership(ctx, db, ev)
+		}
+		audit.AccountID = linkedAccount
+		if errors.Is(err, errPaymentNotFound) || errors.Is(err, errMembershipNotFound) {
+			// Nothing to undo; a 200 would hide the mismatch from the provider's logs
+			logger.Warn("payment: %s for %s: %v", ev.Type, ev.TransactionID, err)
+			audit.Result = "not_found"
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errDuplicatePayment) {
+			// Providers retry until they get a 200; the first delivery already counted
+			logger.Info("payment: transaction %s already processed", ev.TransactionID)
+			audit.Result = "duplicate"
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			return
+		}
 		if err != nil {
-			return fmt.Errorf("insert error: %v", err)
+			logger.Error("payment: failed to process %s: %v", ev.Type, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
 		}
+		logger.Done("payment: processed membership for %s", ev.Email)
+		audit.Result = "ok"
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
 	}
+}
 
-	return nil
+// processMembership records the payment in the ledger and recomputes the
+// expiry of the membership for ev.Email, creating the membership if needed. It
+// returns the GD account the membership is linked to, if any, or
+// errDuplicatePayment if the transaction was already processed.
+func processMembership(ctx context.Context, db *sql.DB, ev *paymentEvent) (string, error) {
+	logger := log.FromContext(ctx)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if err := ensureTier(ctx, tx, ev.Tier); err != nil {
+		return "", err
+	}
+
+	var membershipID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM memberships WHERE email = ? ORDER BY id DESC LIMIT 1 FOR UPDATE", ev.Email).Scan(&membershipID)
+	switch {
+	case err == sql.ErrNoRows:
+		logger.Info("payment: creating new membership for %s", ev.Email)
+		insertStmt := `INSERT INTO memberships (kofi_transaction_id, email, discord_username, discord_userid, tier_name, expires_at) VALUES (?, ?, ?, ?, ?, NOW())`
+		res, err := tx.ExecContext(ctx, insertStmt, ev.TransactionID, ev.Email, ev.DiscordUsername, ev.DiscordUserID, ev.Tier)
+		if err != nil {
+			return "", fmt.Errorf("insert error: %v", err)
+		}
+		if membershipID, err = res.LastInsertId(); err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", fmt.Errorf("lookup error: %v", err)
+	default:
+		// kofi_transaction_id holds the latest payment; the ledger keeps them all
+		if _, err := tx.ExecContext(ctx, "UPDATE memberships SET kofi_transaction_id = ?, tier_name = ? WHERE id = ?", ev.TransactionID, ev.Tier, membershipID); err != nil {
+			return "", fmt.Errorf("update error: %v", err)
+		}
+	}
+
+	err = insertPayment(ctx, tx, &ledgerEntry{
+		Provider:      ev.Provider,
+		TransactionID: ev.TransactionID,
+		MembershipID:  membershipID,
+		Type:          ev.Type,
+		TierName:      ev.Tier,
+		Amount:        ev.Amount,
+		Currency:      ev.Currency,
+		Months:        ev.Months,
+		Days:          ev.Days,
+		PaidAt:        ev.PaidAt,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	expiry, accountID, err := syncMembershipExpiry(ctx, tx, membershipID)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	logger.Info("payment: membership %d for %s now expires %v", membershipID, ev.Email, expiry)
+	return accountID, nil
+}
+
+var errMembershipNotFound = errors.New("membership not found")
+
+// cancelMembership ends the membership for ev.Email now, recording the
+// cancellation under ev.TransactionID. It returns the linked account, if any,
+// errMembershipNotFound, or errDuplicatePayment if it was already recorded.
+func cancelMembership(ctx context.Context, db *sql.DB, ev *paymentEvent) (string, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var membershipID int64
+	err = tx.QueryRowContext(ctx, "SELECT id FROM memberships WHERE email = ? ORDER BY id DESC LIMIT 1 FOR UPDATE", ev.Email).Scan(&membershipID)
+	if err == sql.ErrNoRows {
+		return "", errMembershipNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("lookup error: %v", err)
+	}
+	if err := addCancellation(ctx, tx, membershipID, ev.Provider, ev.TransactionID); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE memberships SET expires_at = NOW() WHERE id = ? AND expires_at IS NULL", membershipID); err != nil {
+		return "", fmt.Errorf("update error: %v", err)
+	}
+	_, accountID, err := syncMembershipExpiry(ctx, tx, membershipID)
+	if err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	log.FromContext(ctx).Info("payment: membership %d for %s cancelled", membershipID, ev.Email)
+	return accountID, nil
 }
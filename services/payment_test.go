@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The fixtures in testdata/kofi are sample Ko-fi webhook payloads. Ko-fi sends
+// them form-encoded as the "data" field, which kofiForm reproduces.
+
+const fixtureToken = "test-verification-token"
+
+func readFixture(t *testing.T, name string) string {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "kofi", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func kofiForm(payload string) string {
+	return url.Values{"data": {payload}}.Encode()
+}
+
+func withConfig(t *testing.T, edit func(c *Config)) {
+	t.Helper()
+	prev := cfg()
+	next := *prev
+	edit(&next)
+	setConfig(&next)
+	t.Cleanup(func() { setConfig(prev) })
+}
+
+func TestParsePaymentRequestFixtures(t *testing.T) {
+	tests := []struct {
+		fixture      string
+		typ          string
+		tier         string
+		amount       string
+		currency     string
+		email        string
+		transaction  string
+		discordID    string
+		subscription bool
+		first        bool
+	}{
+		{"donation.json", "Donation", defaultTierName, "3.00", "USD", "someone@example.com", "00000000-1111-2222-3333-444444444444", "", false, false},
+		{"subscription_first.json", "Subscription", "Account Backup Extra", "5.00", "EUR", "fan@example.com", "11111111-2222-3333-4444-555555555555", "123456789012345678", true, true},
+		{"subscription_renewal.json", "Subscription", "Account Backup Ultra", "10.00", "EUR", "fan@example.com", "22222222-3333-4444-5555-666666666666", "123456789012345678", true, false},
+		{"shop_order.json", "Shop Order", defaultTierName, "12.50", "GBP", "maker@example.com", "33333333-4444-5555-6666-777777777777", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			req, err := parsePaymentRequest("application/x-www-form-urlencoded", []byte(kofiForm(readFixture(t, tt.fixture))))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if req.VerificationToken != fixtureToken {
+				t.Errorf("verification token = %q", req.VerificationToken)
+			}
+			if req.Type != tt.typ {
+				t.Errorf("type = %q, want %q", req.Type, tt.typ)
+			}
+			if got := req.tier(); got != tt.tier {
+				t.Errorf("tier = %q, want %q", got, tt.tier)
+			}
+			if req.Amount != tt.amount || req.Currency != tt.currency {
+				t.Errorf("amount = %s %s, want %s %s", req.Amount, req.Currency, tt.amount, tt.currency)
+			}
+			if req.Email != tt.email {
+				t.Errorf("email = %q, want %q", req.Email, tt.email)
+			}
+			if req.KofiTransactionID != tt.transaction {
+				t.Errorf("transaction = %q, want %q", req.KofiTransactionID, tt.transaction)
+			}
+			if req.DiscordUserID != tt.discordID {
+				t.Errorf("discord user id = %q, want %q", req.DiscordUserID, tt.discordID)
+			}
+			if req.IsSubscriptionPayment != tt.subscription || req.IsFirstSubscriptionPayment != tt.first {
+				t.Errorf("subscription = %v/%v, want %v/%v", req.IsSubscriptionPayment, req.IsFirstSubscriptionPayment, tt.subscription, tt.first)
+			}
+		})
+	}
+}
+
+func TestParsePaymentRequestJSONBody(t *testing.T) {
+	req, err := parsePaymentRequest("application/json", []byte(readFixture(t, "subscription_first.json")))
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if req.KofiTransactionID != "11111111-2222-3333-4444-555555555555" || !req.IsFirstSubscriptionPayment {
+		t.Errorf("unexpected payload: %+v", req)
+	}
+}
+
+func TestParsePaymentRequestInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"missing data field", "application/x-www-form-urlencoded", "foo=bar"},
+		{"data is not JSON", "application/x-www-form-urlencoded", kofiForm("not json")},
+		{"form body sent as JSON", "application/json", kofiForm(`{"type":"Donation"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePaymentRequest(tt.contentType, []byte(tt.body)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestVerifyPaymentToken(t *testing.T) {
+	tests := []struct {
+		expected, got string
+		want          bool
+	}{
+		{"secret", "secret", true},
+		{"secret", "Secret", false},
+		{"secret", "secret2", false},
+		{"secret", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := verifyPaymentToken(tt.expected, tt.got); got != tt.want {
+			t.Errorf("verifyPaymentToken(%q, %q) = %v, want %v", tt.expected, tt.got, got, tt.want)
+		}
+	}
+}
+
+func TestPaymentHandler(t *testing.T) {
+	donation := readFixture(t, "donation.json")
+	tests := []struct {
+		name        string
+		method      string
+		configured  string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"wrong method", http.MethodGet, fixtureToken, "", "", http.StatusMethodNotAllowed},
+		{"missing data", http.MethodPost, fixtureToken, "application/x-www-form-urlencoded", "foo=bar", http.StatusBadRequest},
+		{"no token configured", http.MethodPost, "", "application/x-www-form-urlencoded", kofiForm(donation), http.StatusForbidden},
+		{"wrong token", http.MethodPost, "other-token", "application/x-www-form-urlencoded", kofiForm(donation), http.StatusForbidden},
+		{"missing transaction ID", http.MethodPost, fixtureToken, "application/x-www-form-urlencoded", kofiForm(strings.Replace(donation, `"kofi_transaction_id": "00000000-1111-2222-3333-444444444444"`, `"kofi_transaction_id": ""`, 1)), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.VerificationToken = tt.configured })
+
+			r := httptest.NewRequest(tt.method, "/payment", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			paymentHandler(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d (body %q)", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestReplayLedger(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, time.March, d, 12, 0, 0, 0, time.UTC) }
+	entries := []ledgerEntry{
+		// Carried over from before the ledger: keeps its span
+		{PaidAt: day(1), StartsAt: day(1), EndsAt: day(10)},
+		// Paid while the legacy span is running: queued after it
+		{PaidAt: day(5), Months: 1},
+		// A manual grant stacks on top
+		{PaidAt: day(6), Days: 3},
+	}
+	expiry := replayLedger(entries)
+
+	if !entries[1].StartsAt.Equal(day(10)) || !entries[1].EndsAt.Equal(time.Date(2025, time.April, 10, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("second entry spans %v - %v", entries[1].StartsAt, entries[1].EndsAt)
+	}
+	want := time.Date(2025, time.April, 13, 12, 0, 0, 0, time.UTC)
+	if !expiry.Equal(want) || !entries[2].EndsAt.Equal(want) {
+		t.Errorf("expiry = %v, want %v", expiry, want)
+	}
+
+	// Replaying the same entries again gives the same result
+	if again := replayLedger(entries); !again.Equal(expiry) {
+		t.Errorf("replay is not stable: %v != %v", again, expiry)
+	}
+
+	// A lapse leaves a gap: the next payment starts when it was made
+	late := []ledgerEntry{{PaidAt: day(1), Days: 2}, {PaidAt: day(20), Days: 2}}
+	if got := replayLedger(late); !got.Equal(day(22)) {
+		t.Errorf("expiry after lapse = %v, want %v", got, day(22))
+	}
+}
+
+func TestReplayLedgerRefundsAndCancellations(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, time.March, d, 12, 0, 0, 0, time.UTC) }
+	refunded := day(4)
+
+	tests := []struct {
+		name    string
+		entries []ledgerEntry
+		want    time.Time
+	}{
+		{
+			name:    "refunded payment counts for nothing",
+			entries: []ledgerEntry{{PaidAt: day(1), Days: 10}, {PaidAt: day(2), Days: 5, RefundedAt: &refunded}},
+			want:    day(11),
+		},
+		{
+			name:    "refund pulls later payments forward",
+			entries: []ledgerEntry{{PaidAt: day(1), Days: 10, RefundedAt: &refunded}, {PaidAt: day(2), Days: 5}},
+			want:    day(7),
+		},
+		{
+			name:    "cancellation ends the membership when recorded",
+			entries: []ledgerEntry{{PaidAt: day(1), Days: 30}, {PaidAt: day(5), Cancellation: true}},
+			want:    day(5),
+		},
+		{
+			name:    "payment after a cancellation starts again",
+			entries: []ledgerEntry{{PaidAt: day(1), Days: 30}, {PaidAt: day(5), Cancellation: true}, {PaidAt: day(6), Days: 2}},
+			want:    day(8),
+		},
+		{
+			name:    "negative days shorten",
+			entries: []ledgerEntry{{PaidAt: day(1), Days: 20}, {PaidAt: day(2), Days: -5}},
+			want:    day(16),
+		},
+		{
+			name:    "shortening stops at the time it was made",
+			entries: []ledgerEntry{{PaidAt: day(1), Days: 5}, {PaidAt: day(3), Days: -30}},
+			want:    day(3),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replayLedger(tt.entries); !got.Equal(tt.want) {
+				t.Errorf("expiry = %v, want %v", got, tt.want)
+			}
+			for i, e := range tt.entries {
+				if e.RefundedAt != nil && !e.EndsAt.Equal(e.StartsAt) {
+					t.Errorf("refunded entry %d spans %v - %v", i, e.StartsAt, e.EndsAt)
+				}
+			}
+		})
+	}
+}
+
+func TestPaidAt(t *testing.T) {
+	req := PaymentRequest{Timestamp: "2025-03-02T18:22:11Z"}
+	if got := req.paidAt(); !got.Equal(time.Date(2025, time.March, 2, 18, 22, 11, 0, time.UTC)) {
+		t.Errorf("paidAt = %v", got)
+	}
+	for _, ts := range []string{"", "yesterday", time.Now().Add(time.Hour).Format(time.RFC3339)} {
+		req := PaymentRequest{Timestamp: ts}
+		if got := req.paidAt(); time.Since(got) > time.Minute || got.After(time.Now()) {
+			t.Errorf("paidAt(%q) = %v, want now", ts, got)
+		}
+	}
+}
+
+func signBody(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSignedWebhookProvider(t *testing.T) {
+	const secret = "webhook-secret"
+	tests := []struct {
+		name      string
+		secret    string
+		body      string
+		signature string // defaults to a valid signature
+		status    int    // expected webhookError status, 0 for success
+		check     func(t *testing.T, ev *paymentEvent)
+	}{
+		{
+			name:   "payment with defaults",
+			secret: secret,
+			body:   `{"transactionId":"inv_1","email":"player@example.com","amount":5,"currency":"USD"}`,
+			check: func(t *testing.T, ev *paymentEvent) {
+				if ev.TransactionID != "inv_1" || ev.Email != "player@example.com" || ev.Amount != "5" {
+					t.Errorf("unexpected event: %+v", ev)
+				}
+				if ev.Tier != defaultTierName || ev.Months != 1 || ev.Days != 0 || ev.Refund {
+					t.Errorf("defaults not applied: %+v", ev)
+				}
+			},
+		},
+		{
+			name:   "explicit period, tier and payment time",
+			secret: secret,
+			body:   `{"transaction_id":"inv_2","email":"player@example.com","tier":"Gold","days":90,"paidAt":"2025-01-02T03:04:05Z"}`,
+			check: func(t *testing.T, ev *paymentEvent) {
+				if ev.Tier != "Gold" || ev.Months != 0 || ev.Days != 90 {
+					t.Errorf("unexpected event: %+v", ev)
+				}
+				if !ev.PaidAt.Equal(time.Date(2025, time.January, 2, 3, 4, 5, 0, time.UTC)) {
+					t.Errorf("paidAt = %v", ev.PaidAt)
+				}
+			},
+		},
+		{
+			name:   "refund",
+			secret: secret,
+			body:   `{"transactionId":"inv_1","email":"player@example.com","refund":true}`,
+			check: func(t *testing.T, ev *paymentEvent) {
+				if !ev.Refund || ev.Type != "Refund" || ev.Months != 0 {
+					t.Errorf("unexpected event: %+v", ev)
+				}
+			},
+		},
+		{
+			name:   "cancellation",
+			secret: secret,
+			body:   `{"transactionId":"sub_1_cancel","email":"player@example.com","cancel":true,"months":3}`,
+			check: func(t *testing.T, ev *paymentEvent) {
+				if !ev.Cancel || ev.Refund || ev.Type != "Cancellation" || ev.Months != 0 {
+					t.Errorf("unexpected event: %+v", ev)
+				}
+			},
+		},
+		{name: "refund and cancel", secret: secret, body: `{"transactionId":"inv_1","email":"a@b.c","refund":true,"cancel":true}`, status: http.StatusBadRequest},
+		{name: "disabled", secret: "", body: `{"transactionId":"inv_1","email":"a@b.c"}`, status: http.StatusForbidden},
+		{name: "wrong signature", secret: secret, body: `{"transactionId":"inv_1","email":"a@b.c"}`, signature: signBody("other", `{"transactionId":"inv_1","email":"a@b.c"}`), status: http.StatusForbidden},
+		{name: "malformed signature", secret: secret, body: `{"transactionId":"inv_1","email":"a@b.c"}`, signature: "sha256=zz", status: http.StatusForbidden},
+		{name: "missing email", secret: secret, body: `{"transactionId":"inv_1"}`, status: http.StatusBadRequest},
+		{name: "negative period", secret: secret, body: `{"transactionId":"inv_1","email":"a@b.c","months":-1}`, status: http.StatusBadRequest},
+		{name: "bad paidAt", secret: secret, body: `{"transactionId":"inv_1","email":"a@b.c","paidAt":"yesterday"}`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.PaymentWebhookSecret = tt.secret })
+
+			sig := tt.signature
+			if sig == "" {
+				sig = signBody(secret, tt.body)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/payment/webhook", strings.NewReader(tt.body))
+			r.Header.Set(signatureHeader, sig)
+			ev, err := signedWebhookProvider{}.ParseWebhook(r, []byte(tt.body))
+
+			if tt.status != 0 {
+				var werr *webhookError
+				if !errors.As(err, &werr) || werr.Status != tt.status {
+					t.Fatalf("err = %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, ev)
+		})
+	}
+}
+
+func TestKofiProviderEvent(t *testing.T) {
+	withConfig(t, func(c *Config) { c.VerificationToken = fixtureToken })
+
+	body := kofiForm(readFixture(t, "subscription_renewal.json"))
+	r := httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ev, err := kofiProvider{}.ParseWebhook(r, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev.TransactionID != "22222222-3333-4444-5555-666666666666" || ev.Tier != "Account Backup Ultra" || ev.Months != 1 || ev.Refund {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+	if !ev.PaidAt.Equal(time.Date(2025, time.April, 2, 18, 22, 14, 0, time.UTC)) {
+		t.Errorf("paidAt = %v", ev.PaidAt)
+	}
+
+	body = kofiForm(readFixture(t, "donation.json"))
+	r = httptest.NewRequest(http.MethodPost, "/payment", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if ev, err = (kofiProvider{}).ParseWebhook(r, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	if ev.TransactionID != "00000000-1111-2222-3333-444444444444" || ev.Type != "Donation" || ev.Email != "someone@example.com" || ev.Amount != "3.00" || ev.Months != 1 {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
+
+func TestOverQuotaState(t *testing.T) {
+	c := defaultConfig()
+	c.OverQuotaGraceDays = 10
+	since := time.Now().Add(-3 * 24 * time.Hour)
+
+	if got := c.overQuotaState(100, 100, since); got != nil {
+		t.Errorf("backup at the quota reported over quota: %+v", got)
+	}
+	got := c.overQuotaState(150, 100, since)
+	if got == nil {
+		t.Fatal("backup over the quota not reported")
+	}
+	if got.OverBy != 50 || !got.TrimAt.Equal(since.AddDate(0, 0, 10)) || got.TrimInDays != 7 {
+		t.Errorf("unexpected state: %+v", got)
+	}
+	// Past the grace period it is due now
+	if late := c.overQuotaState(150, 100, since.AddDate(0, 0, -30)); late.TrimInDays != 0 {
+		t.Errorf("trimInDays = %d, want 0", late.TrimInDays)
+	}
+}
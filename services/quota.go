@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// An account whose live backup is larger than its tier allows, usually because
+// a membership lapsed, is over quota. Its backup stays readable, and saves that
+// don't make it bigger are accepted so the player can make room. Once it has
+// been over quota for OVER_QUOTA_GRACE_DAYS the over-quota-trim job trims it:
+//
+//  1. This server keeps one version per account, so there are no older
+//     versions to drop.
+//  2. The level data is removed. The save data is never trimmed.
+//  3. If the save data alone is still over the quota, the account stays
+//     flagged, so saves that would make it bigger keep being refused until the
+//     player makes room or renews.
+//
+// Membership changes and saves update the flag straight away; the
+// subscriber-expiry job catches memberships that simply ran out.
+
+// overQuota describes how far over its quota an account is and when it will
+// be trimmed.
+type overQuota struct {
+	OverBy     int       `json:"overBy"`
+	Since      time.Time `json:"since"`
+	TrimAt     time.Time `json:"trimAt"`
+	TrimInDays int       `json:"trimInDays"`
+}
+
+// overQuotaState returns the over-quota state of a backup of size bytes with
+// the given quota, flagged at since, or nil if it fits.
+func (c *Config) overQuotaState(size, quota int, since time.Time) *overQuota {
+	if size <= quota {
+		return nil
+	}
+	trimAt := since.AddDate(0, 0, c.OverQuotaGraceDays)
+	return &overQuota{OverBy: size - quota, Since: since, TrimAt: trimAt, TrimInDays: daysUntil(trimAt)}
+}
+
+// updateQuotaState flags an account whose live backup no longer fits its tier,
+// keeping the time it first went over, and clears the flag once it fits again.
+func updateQuotaState(ctx context.Context, conn sqlConn, accountID string) error {
+	limits, err := accountTier(ctx, conn, accountID)
+	if err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, `UPDATE accounts SET over_quota_since = IF(
+			(SELECT COALESCE(SUM(LENGTH(s.save_data) + LENGTH(s.level_data)), 0) FROM saves s WHERE s.account_id = ? AND s.deleted_at IS NULL) > ?,
+			COALESCE(over_quota_since, CURRENT_TIMESTAMP), NULL)
+		WHERE account_id = ?`, accountID, limits.MaxDataSize, accountID)
+	if err != nil {
+		return fmt.Errorf("quota state update: %w", err)
+	}
+	return nil
+}
+
+// markOverQuota brings the over-quota flag of every account up to date. It
+// returns the number of accounts newly flagged (or, with dryRun, that would be).
+func markOverQuota(ctx context.Context, db *sql.DB, dryRun bool) (int64, error) {
+	conf := cfg()
+	rows, err := db.QueryContext(ctx, `SELECT x.account_id, COALESCE(x.bytes, 0) > `+tierQuotaSQL+`
+		FROM (
+			SELECT a.account_id, a.over_quota_since IS NOT NULL AS flagged,
+				CASE WHEN s.deleted_at IS NULL THEN LENGTH(s.save_data) + LENGTH(s.level_data) END AS bytes,
+				`+accountTierNameSQL+` AS tier_name
+			FROM accounts a
+			LEFT JOIN saves s ON a.account_id = s.account_id
+		) x
+		LEFT JOIN tiers t ON t.name = x.tier_name
+		WHERE (COALESCE(x.bytes, 0) > `+tierQuotaSQL+`) <> x.flagged`, append(conf.tierQuotaArgs(), conf.tierQuotaArgs()...)...)
+	if err != nil {
+		return 0, err
+	}
+	var flag, clear []string
+	for rows.Next() {
+		var accountID string
+		var over bool
+		if err := rows.Scan(&accountID, &over); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if over {
+			flag = append(flag, accountID)
+		} else {
+			clear = append(clear, accountID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return int64(len(flag)), nil
+	}
+
+	var n int64
+	for _, accountID := range flag {
+		res, err := db.ExecContext(ctx, "UPDATE accounts SET over_quota_since = CURRENT_TIMESTAMP WHERE account_id = ? AND over_quota_since IS NULL", accountID)
+		if err != nil {
+			return n, err
+		}
+		affected, _ := res.RowsAffected()
+		n += affected
+	}
+	for _, accountID := range clear {
+		if _, err := db.ExecContext(ctx, "UPDATE accounts SET over_quota_since = NULL WHERE account_id = ?", accountID); err != nil {
+			return n, err
+		}
+	}
+	if len(clear) > 0 {
+		log.Debug("cleanup: %d accounts are back within their quota", len(clear))
+	}
+	return n, nil
+}
+
+// trimBackup trims the backup of an over-quota account following the policy
+// above and clears its flag if the backup fits afterwards. It returns the
+// bytes removed (or, with dryRun, that would be), which is 0 if the backup fits
+// again or has no level data left to remove.
+func trimBackup(ctx context.Context, db *sql.DB, accountID string, dryRun bool) (int64, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var saveBytes, levelBytes int64
+	err = tx.QueryRowContext(ctx, "SELECT LENGTH(save_data), LENGTH(level_data) FROM saves WHERE account_id = ? AND deleted_at IS NULL FOR UPDATE", accountID).Scan(&saveBytes, &levelBytes)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	limits, err := accountTier(ctx, tx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	quota := int64(limits.MaxDataSize)
+
+	var trimmed int64
+	if saveBytes+levelBytes > quota {
+		trimmed = levelBytes
+	}
+	if dryRun {
+		return trimmed, nil
+	}
+	if trimmed > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE saves SET level_data = '' WHERE account_id = ? AND deleted_at IS NULL", accountID); err != nil {
+			return 0, err
+		}
+	}
+	if saveBytes+levelBytes-trimmed <= quota {
+		// Renewed, made room or trimmed enough
+		if _, err := tx.ExecContext(ctx, "UPDATE accounts SET over_quota_since = NULL WHERE account_id = ?", accountID); err != nil {
+			return 0, err
+		}
+	}
+	return trimmed, tx.Commit()
+}
+
+func trimOverQuotaPhase(ctx context.Context, conf *Config, report *cleanupReport) {
+	rows, err := DB.QueryContext(ctx, "SELECT account_id FROM accounts WHERE over_quota_since < DATE_SUB(NOW(), INTERVAL ? DAY)", conf.OverQuotaGraceDays)
+	if err != nil {
+		report.addError("failed to find over-quota accounts: %v", err)
+		return
+	}
+	var accountIDs []string
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			break
+		}
+		accountIDs = append(accountIDs, id)
+	}
+	rows.Close()
+	if err == nil {
+		err = rows.Err()
+	}
+	if err != nil {
+		report.addError("failed to find over-quota accounts: %v", err)
+		return
+	}
+
+	for _, accountID := range accountIDs {
+		trimmed, err := trimBackup(ctx, DB, accountID, report.DryRun)
+		if err != nil {
+			report.addError("failed to trim %s: %v", accountID, err)
+			continue
+		}
+		if trimmed == 0 {
+			continue
+		}
+		report.OverQuotaTrimmed++
+		report.OverQuotaBytesTrimmed += trimmed
+		log.Info("cleanup: %s %d bytes from over-quota account %s", verbFor(report.DryRun, "trimmed"), trimmed, accountID)
+	}
+	if !report.DryRun {
+		cleanupRowsDeleted.Add(float64(report.OverQuotaTrimmed), "over_quota_trimmed")
+	}
+}
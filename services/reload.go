@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// configArgs are the command line args the server was started with, re-parsed
+// on every reload so flags keep taking precedence.
+var configArgs []string
+
+var reloadMu sync.Mutex
+
+type reloadResult struct {
+	Changed         []string `json:"changed"`
+	RequiresRestart []string `json:"requiresRestart"`
+}
+
+// reloadConfig re-reads the config file and environment, validates the result
+// and atomically swaps it in. Settings that need a restart keep their current
+// value and are reported separately.
+func reloadConfig() (reloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	res := reloadResult{Changed: []string{}, RequiresRestart: []string{}}
+	next, _, err := loadConfig(configArgs)
+	if err != nil {
+		return res, err
+	}
+
+	cur := cfg()
+	curFields := cur.fields()
+	for i, f := range next.fields() {
+		old := curFields[i]
+		if reflect.DeepEqual(old.value.Interface(), f.value.Interface()) {
+			continue
+		}
+		if f.Restart {
+			res.RequiresRestart = append(res.RequiresRestart, f.Env)
+			f.value.Set(old.value)
+			continue
+		}
+		res.Changed = append(res.Changed, f.Env)
+	}
+
+	setConfig(next)
+	for _, env := range res.Changed {
+		log.Info("config: reloaded %s", env)
+	}
+	for _, env := range res.RequiresRestart {
+		log.Warn("config: %s changed but requires a restart to take effect", env)
+	}
+	return res, nil
+}
+
+// watchReloadSignal reloads the configuration whenever SIGHUP is received.
+func watchReloadSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			log.Info("config: SIGHUP received, reloading")
+			if _, err := reloadConfig(); err != nil {
+				log.Error("config: reload failed, keeping current configuration: %v", err)
+			}
+		}
+	}()
+}
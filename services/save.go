@@ -9,8 +9,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"strconv"
 	"strings"
 	"time"
 
@@ -62,9 +60,10 @@ func init() {
 }
 
 func saveHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Warn("save: invalid method %s", r.Method)
+		logger.Warn("save: invalid method %s", r.Method)
 		return
 	}
 
@@ -78,11 +77,11 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if errors.Is(err, io.ErrUnexpectedEOF) {
-			log.Warn("save: incomplete JSON body from %s", req.AccountId)
+			logger.Warn("save: incomplete JSON body from %s", req.AccountId)
 			http.Error(w, "Incomplete JSON body", http.StatusBadRequest)
 			return
 		}
-		log.Warn("save: json decode error: %v content-type=%s", err, r.Header.Get("Content-Type"))
+		logger.Warn("save: json decode error: %v content-type=%s", err, r.Header.Get("Content-Type"))
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
@@ -90,24 +89,18 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 	savePreview := redactPreview(req.SaveData, 120)
 	levelPreview := redactPreview(req.LevelData, 120)
 	argonPreview := redactPreview(req.ArgonToken, 80)
-	log.Debug("save: parsed body as JSON (accountId='%s', saveDataPreview='%s', levelDataPreview='%s', argonTokenPreview='%s')", req.AccountId, savePreview, levelPreview, argonPreview)
+	logger.Debug("save: parsed body as JSON (accountId='%s', saveDataPreview='%s', levelDataPreview='%s', argonTokenPreview='%s')", req.AccountId, savePreview, levelPreview, argonPreview)
 	if req.AccountId == "" || req.ArgonToken == "" || (req.SaveData == "" && req.LevelData == "") {
-		log.Warn("save: missing data request from %s", req.AccountId)
+		logger.Warn("save: missing data request from %s", req.AccountId)
 		http.Error(w, "Missing Account ID, Argon Token or Data", http.StatusBadRequest)
 		return
 	}
+	logger = logger.With("account_id", req.AccountId)
 
-	maxDataSize := 33554432
-	if v := os.Getenv("MAX_DATA_SIZE_BYTES"); v != "" {
-		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-			maxDataSize = parsed
-		}
-	}
+	audit := newAuditEvent(r, "save", req.AccountId)
+	defer audit.record()
 
-	dbMaxAllowedPacket := os.Getenv("DB_MAX_ALLOWED_PACKET")
-	if dbMaxAllowedPacket == "" {
-		dbMaxAllowedPacket = "1073741824"
-	}
+	conf := cfg()
 
 	// Increase context timeout to 5 minutes to allow for large save uploads
 	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Minute)
@@ -115,32 +108,7 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 
 	db := DB
 	if db == nil {
-		log.Error("save: DB not initialized")
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	createStmt := `CREATE TABLE IF NOT EXISTS saves (
-		id BIGINT AUTO_INCREMENT PRIMARY KEY,
-		account_id VARCHAR(255) NOT NULL,
-		save_data LONGTEXT NOT NULL,
-		level_data LONGTEXT NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		UNIQUE KEY unique_account (account_id)
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
-	if _, err := db.ExecContext(ctx, createStmt); err != nil {
-		log.Error("save: create table error: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	acctCreate := `CREATE TABLE IF NOT EXISTS accounts (
-		account_id VARCHAR(255) PRIMARY KEY,
-		argon_token VARCHAR(512) NOT NULL,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;`
-	if _, err := db.ExecContext(ctx, acctCreate); err != nil {
-		log.Error("save: create accounts table error: %v", err)
+		logger.Error("save: DB not initialized")
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -151,58 +119,74 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 	row := db.QueryRowContext(ctx, "SELECT argon_token, subscriber FROM accounts WHERE account_id = ?", req.AccountId)
 	switch err := row.Scan(&storedToken, &isSubscriber); err {
 	case sql.ErrNoRows:
-		log.Error("save: init POST for new account %s", req.AccountId)
+		logger.Error("save: init POST for new account %s", req.AccountId)
 		if _, err := execWithRetries(ctx, db, "INSERT INTO accounts (account_id, argon_token, subscriber) VALUES (?, ?, ?)", req.AccountId, req.ArgonToken, false); err != nil {
-			log.Error("save: insert account error: %v", err)
+			logger.Error("save: insert account error: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 			return
 		}
 	case nil:
 	default:
-		log.Error("save: account lookup error: %v", err)
+		logger.Error("save: account lookup error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
-	// Update maxDataSize based on subscriber status
-	if isSubscriber {
-		// Default 128MB for subscribers
-		maxDataSize = 134217728
-
-		// Allow override via env var if provided
-		if v := os.Getenv("SUBSCRIBER_MAX_DATA_SIZE_BYTES"); v != "" {
-			if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-				maxDataSize = parsed
-			}
-		}
-	}
-
 	ok, verr := ValidateArgonToken(ctx, db, req.AccountId, req.ArgonToken)
 	if verr != nil {
-		log.Error("save: token validation error for %s: %v", req.AccountId, verr)
+		logger.Error("save: token validation error for %s: %v", req.AccountId, verr)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 	if !ok {
-		log.Warn("save: token validation failed for %s", req.AccountId)
+		logger.Warn("save: token validation failed for %s", req.AccountId)
+		audit.Result = "denied"
 		http.Error(w, "Invalid Argon Token", http.StatusForbidden)
 		return
 	}
 
-	// Ensure row exists with empty data if not present
-	//INSERT IGNORE so it does nothing if the row already exists.
-	// This splits the operation: first ensure row, then update columns separately.
-	ensureStmt := "INSERT IGNORE INTO saves (account_id, save_data, level_data) VALUES (?, '', '')"
-	if _, err := execWithRetries(ctx, db, ensureStmt, req.AccountId); err != nil {
-		log.Error("save: ensure row error: %v", err)
+	limits, err := accountTier(ctx, db, req.AccountId)
+	if err != nil {
+		logger.Error("save: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	maxDataSize := limits.MaxDataSize
+
+	limited, err := rateLimited(ctx, db, req.AccountId, limits.SavesPerHour, "save")
+	if err != nil {
+		logger.Error("save: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if limited {
+		logger.Warn("save: %s tier limit of %d saves per hour reached", limits.Name, limits.SavesPerHour)
+		audit.Result = "rate_limited"
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, "Too many saves, try again later", http.StatusTooManyRequests)
+		return
+	}
 
-	// Check total storage limit (Combines new data with existing data)
+	// Use configured max_allowed_packet for validation
+	maxAllowedPacket := conf.DBMaxAllowedPacket
+	logger.Debug("save: using configured max_allowed_packet %d bytes", maxAllowedPacket)
+	if len(req.SaveData) > maxAllowedPacket {
+		logger.Error("save: save_data size %d exceeds configured max_allowed_packet %d", len(req.SaveData), maxAllowedPacket)
+		http.Error(w, "Save data size exceeded max allowed packet", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(req.LevelData) > maxAllowedPacket {
+		logger.Error("save: level_data size %d exceeds configured max_allowed_packet %d", len(req.LevelData), maxAllowedPacket)
+		http.Error(w, "Level data size exceeded max allowed packet", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Check total storage limit (Combines new data with existing data).
+	// A trashed backup counts as empty since this save replaces it.
 	var curSaveBytes, curLevelBytes int64
-	if err := db.QueryRowContext(ctx, "SELECT LENGTH(save_data), LENGTH(level_data) FROM saves WHERE account_id = ?", req.AccountId).Scan(&curSaveBytes, &curLevelBytes); err != nil {
-		log.Error("save: size lookup error: %v", err)
+	err = db.QueryRowContext(ctx, "SELECT IF(deleted_at IS NULL, LENGTH(save_data), 0), IF(deleted_at IS NULL, LENGTH(level_data), 0) FROM saves WHERE account_id = ?", req.AccountId).Scan(&curSaveBytes, &curLevelBytes)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("save: size lookup error: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -217,57 +201,36 @@ func saveHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	totalProposed := newSaveSize + newLevelSize
-	if totalProposed > int64(maxDataSize) {
-		log.Warn("save: combined data size %d exceeds limit of %d bytes", totalProposed, maxDataSize)
+	curTotal := curSaveBytes + curLevelBytes
+	// Over-quota accounts can still save as long as the backup doesn't grow
+	if totalProposed > int64(maxDataSize) && totalProposed > curTotal {
+		logger.Warn("save: combined data size %d exceeds limit of %d bytes", totalProposed, maxDataSize)
+		audit.Result = "too_large"
+		audit.Bytes = int64(len(req.SaveData) + len(req.LevelData))
 		http.Error(w, "Storage limit exceeded", http.StatusRequestEntityTooLarge)
 		return
 	}
 
-	// Update save_data if present
-	// Use configured max_allowed_packet from env for validation
-	maxAllowedPacket, err := strconv.Atoi(dbMaxAllowedPacket)
-	if err != nil {
-		maxAllowedPacket = 1073741824 // 1GB default if parsing fails
-		log.Warn("save: invalid DB_MAX_ALLOWED_PACKET '%s', defaulting to %d", dbMaxAllowedPacket, maxAllowedPacket)
-	} else {
-		log.Debug("save: using configured max_allowed_packet %d bytes", maxAllowedPacket)
-	}
-
-	// Update save_data if present
-	if req.SaveData != "" {
-		if len(req.SaveData) > maxAllowedPacket {
-			log.Error("save: save_data size %d exceeds configured max_allowed_packet %d", len(req.SaveData), maxAllowedPacket)
-			http.Error(w, "Save data size exceeded max allowed packet", http.StatusRequestEntityTooLarge)
-			return
-		}
-		updateSave := "UPDATE saves SET save_data = ?, created_at = CURRENT_TIMESTAMP WHERE account_id = ?"
-		if _, err := execWithRetries(ctx, db, updateSave, req.SaveData, req.AccountId); err != nil {
-			log.Error("save: update save_data error: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+	logger.Debug("save: writing backup (save_data=%d, level_data=%d bytes)", len(req.SaveData), len(req.LevelData))
+	if err := writeBackup(ctx, db, req.AccountId, req.SaveData, req.LevelData); err != nil {
+		logger.Error("save: write backup error: %v", err)
+		if strings.Contains(err.Error(), "connection reset by peer") {
+			logger.Warn("save: 'connection reset by peer' often indicates that the MySQL server's 'max_allowed_packet' is smaller than the data being sent (%d bytes). Please check your MySQL server configuration (my.cnf/my.ini) and ensure 'max_allowed_packet' is large enough.", len(req.SaveData)+len(req.LevelData))
 		}
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
 	}
 
-	// Update level_data if present
-	if req.LevelData != "" {
-		if len(req.LevelData) > maxAllowedPacket {
-			log.Error("save: level_data size %d exceeds configured max_allowed_packet %d", len(req.LevelData), maxAllowedPacket)
-			http.Error(w, "Level data size exceeded max allowed packet", http.StatusRequestEntityTooLarge)
-			return
-		}
-		log.Debug("save: updating level_data (size=%d)", len(req.LevelData))
-		updateLevel := "UPDATE saves SET level_data = ?, created_at = CURRENT_TIMESTAMP WHERE account_id = ?"
-		if _, err := execWithRetries(ctx, db, updateLevel, req.LevelData, req.AccountId); err != nil {
-			log.Error("save: update level_data error: %v", err)
-			if strings.Contains(err.Error(), "connection reset by peer") {
-				log.Warn("save: 'connection reset by peer' often indicates that the MySQL server's 'max_allowed_packet' is smaller than the data being sent (%d bytes). Please check your MySQL server configuration (my.cnf/my.ini) and ensure 'max_allowed_packet' is large enough.", len(req.LevelData))
-			}
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+	if totalProposed > int64(maxDataSize) || curTotal > int64(maxDataSize) {
+		logger.Info("save: %s is over its quota (%d of %d bytes)", req.AccountId, totalProposed, maxDataSize)
+		if err := updateQuotaState(ctx, db, req.AccountId); err != nil {
+			logger.Warn("save: %v", err)
 		}
 	}
 
-	log.Done("Saved account: %s", req.AccountId)
+	logger.Done("Saved account: %s", req.AccountId)
+	audit.Result = "ok"
+	audit.Bytes = int64(len(req.SaveData) + len(req.LevelData))
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
@@ -322,26 +285,70 @@ func isTransient(err error) bool {
 	return false
 }
 
+// writeBackup stores saveData and/or levelData as the account's backup in one
+// transaction, replacing a trashed backup if there is one. Empty fields are
+// left untouched. The transaction is retried on transient errors.
+func writeBackup(ctx context.Context, db *sql.DB, accountID, saveData, levelData string) error {
+	return withRetries(ctx, func() error {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := discardTrash(ctx, tx, accountID); err != nil {
+			return err
+		}
+		// Ensure row exists with empty data if not present
+		if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO saves (account_id, save_data, level_data) VALUES (?, '', '')", accountID); err != nil {
+			return fmt.Errorf("ensure row: %w", err)
+		}
+		if saveData != "" {
+			if _, err := tx.ExecContext(ctx, "UPDATE saves SET save_data = ?, created_at = CURRENT_TIMESTAMP WHERE account_id = ?", saveData, accountID); err != nil {
+				return fmt.Errorf("update save_data: %w", err)
+			}
+		}
+		if levelData != "" {
+			if _, err := tx.ExecContext(ctx, "UPDATE saves SET level_data = ?, created_at = CURRENT_TIMESTAMP WHERE account_id = ?", levelData, accountID); err != nil {
+				return fmt.Errorf("update level_data: %w", err)
+			}
+		}
+		return tx.Commit()
+	})
+}
+
 func execWithRetries(ctx context.Context, db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
 	var res sql.Result
+	err := withRetries(ctx, func() error {
+		var err error
+		res, err = db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+// withRetries runs fn up to three times, backing off between attempts, while
+// it fails with a transient error.
+func withRetries(ctx context.Context, fn func() error) error {
+	logger := log.FromContext(ctx)
 	var err error
 	backoff := 200 * time.Millisecond
 	for attempt := 1; attempt <= 3; attempt++ {
-		res, err = db.ExecContext(ctx, query, args...)
+		err = fn()
 		if err == nil {
-			return res, nil
+			return nil
 		}
 		if isTransient(err) && attempt < 3 {
-			log.Debug("save: transient db error (attempt %d): %v; retrying after %s", attempt, err, backoff)
+			logger.Debug("save: transient db error (attempt %d): %v; retrying after %s", attempt, err, backoff)
 			select {
 			case <-time.After(backoff):
 				backoff *= 2
 				continue
 			case <-ctx.Done():
-				return nil, ctx.Err()
+				return ctx.Err()
 			}
 		}
 		break
 	}
-	return res, err
+	return err
 }
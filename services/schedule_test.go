@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// Schedules are in server local time
+	saved := time.Local
+	time.Local = time.UTC
+	t.Cleanup(func() { time.Local = saved })
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	for _, tc := range []struct {
+		spec, from string
+		want       []string
+	}{
+		{"30 3 * * *", "2024-05-10 01:00", []string{"2024-05-10 03:30", "2024-05-11 03:30"}},
+		{"30 3 * * *", "2024-05-10 03:30", []string{"2024-05-11 03:30"}},
+		{"*/15 * * * *", "2024-05-10 10:07", []string{"2024-05-10 10:15", "2024-05-10 10:30", "2024-05-10 10:45", "2024-05-10 11:00"}},
+		{"0 */2 * * *", "2024-05-10 09:10", []string{"2024-05-10 10:00", "2024-05-10 12:00"}},
+		{"5/20 * * * *", "2024-05-10 10:00", []string{"2024-05-10 10:05", "2024-05-10 10:25", "2024-05-10 10:45", "2024-05-10 11:05"}},
+		{"0 9-11 * * *", "2024-05-10 10:30", []string{"2024-05-10 11:00", "2024-05-11 09:00"}},
+		{"0 0-12/6 * * *", "2024-05-10 01:00", []string{"2024-05-10 06:00", "2024-05-10 12:00", "2024-05-11 00:00"}},
+		{"0 8,20 * * *", "2024-05-10 09:00", []string{"2024-05-10 20:00", "2024-05-11 08:00"}},
+		{"0 0 1,15 * *", "2024-05-02 00:00", []string{"2024-05-15 00:00", "2024-06-01 00:00"}},
+		// Month and year rollover
+		{"0 0 1 * *", "2024-12-31 23:59", []string{"2025-01-01 00:00", "2025-02-01 00:00"}},
+		{"0 0 31 * *", "2024-04-01 00:00", []string{"2024-05-31 00:00", "2024-07-31 00:00"}},
+		{"0 0 29 2 *", "2024-03-01 00:00", []string{"2028-02-29 00:00"}},
+		{"0 12 * 1-3 *", "2024-03-31 13:00", []string{"2025-01-01 12:00"}},
+		// 2024-05-10 is a Friday; Sunday is 0 or 7
+		{"0 0 * * 1-5", "2024-05-10 12:00", []string{"2024-05-13 00:00", "2024-05-14 00:00"}},
+		{"0 0 * * 7", "2024-05-10 12:00", []string{"2024-05-12 00:00", "2024-05-19 00:00"}},
+		{"@weekly", "2024-05-10 12:00", []string{"2024-05-12 00:00"}},
+		{"@monthly", "2024-05-10 12:00", []string{"2024-06-01 00:00"}},
+		// Day of month and day of week both restricted: either matches
+		{"0 0 13 * 5", "2024-05-10 12:00", []string{"2024-05-13 00:00", "2024-05-17 00:00", "2024-05-24 00:00", "2024-05-31 00:00", "2024-06-07 00:00", "2024-06-13 00:00"}},
+		// Only one restricted: it alone decides
+		{"0 0 13 * *", "2024-05-10 12:00", []string{"2024-05-13 00:00", "2024-06-13 00:00"}},
+		{"@every 90m", "2024-05-10 12:07", []string{"2024-05-10 13:37", "2024-05-10 15:07"}},
+	} {
+		s, err := parseSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tc.spec, err)
+			continue
+		}
+		from := at(tc.from)
+		for _, w := range tc.want {
+			got := s.next(from)
+			if !got.Equal(at(w)) {
+				t.Errorf("%q after %s = %s, want %s", tc.spec, from.Format("2006-01-02 15:04"), got.Format("2006-01-02 15:04"), w)
+				break
+			}
+			from = got
+		}
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"1- * * * *",
+		"-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+		"0 0 30 2 *",
+		"0 0 31 4,6,9,11 *",
+		"@yearly",
+		"@every 30s",
+		"@every soon",
+	} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("parseSchedule(%q) succeeded, want an error", spec)
+		}
+	}
+	if !scheduleDisabled(" off ") || !scheduleDisabled("") || scheduleDisabled("@daily") {
+		t.Error("scheduleDisabled is wrong")
+	}
+}
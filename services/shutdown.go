@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// shutdownStarted is closed once SIGTERM/SIGINT is received.
+var shutdownStarted = make(chan struct{})
+
+// backgroundJobs tracks goroutines started by goBackground, which shutdown
+// waits for. backgroundStopped, guarded by backgroundMu, keeps new ones from
+// being added once shutdown has started waiting.
+var (
+	backgroundMu      sync.Mutex
+	backgroundStopped bool
+	backgroundJobs    sync.WaitGroup
+)
+
+// goBackground runs fn in a goroutine that shutdown waits for. Once shutdown
+// has started it doesn't run fn and returns false.
+func goBackground(fn func()) bool {
+	backgroundMu.Lock()
+	defer backgroundMu.Unlock()
+	if backgroundStopped {
+		return false
+	}
+	backgroundJobs.Add(1)
+	go func() {
+		defer backgroundJobs.Done()
+		fn()
+	}()
+	return true
+}
+
+// stopBackground makes later goBackground calls fail, so backgroundJobs can be
+// waited for.
+func stopBackground() {
+	backgroundMu.Lock()
+	backgroundStopped = true
+	backgroundMu.Unlock()
+}
+
+// jobsCtx is cancelled when background jobs must abort at the shutdown deadline.
+var jobsCtx = context.Background()
+
+type inFlightRequest struct {
+	Route     string
+	RequestID string
+	Remote    string
+	Started   time.Time
+}
+
+var (
+	inFlightMu  sync.Mutex
+	inFlightSeq uint64
+	inFlight    = map[uint64]inFlightRequest{}
+)
+
+// inFlightMiddleware records running requests so shutdown can report what it
+// had to interrupt.
+func inFlightMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlightMu.Lock()
+		inFlightSeq++
+		id := inFlightSeq
+		inFlight[id] = inFlightRequest{
+			Route:     metricsRoute(r),
+			RequestID: log.RequestID(r.Context()),
+			Remote:    r.RemoteAddr,
+			Started:   time.Now(),
+		}
+		inFlightMu.Unlock()
+
+		defer func() {
+			inFlightMu.Lock()
+			delete(inFlight, id)
+			inFlightMu.Unlock()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// waitInFlight waits up to d for running handlers to return and reports
+// whether they all did.
+func waitInFlight(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for len(snapshotInFlight()) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return true
+}
+
+func snapshotInFlight() []inFlightRequest {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	out := make([]inFlightRequest, 0, len(inFlight))
+	for _, req := range inFlight {
+		out = append(out, req)
+	}
+	return out
+}
+
+// closeGrace is how long shutdown waits for handlers to return after their
+// connections were closed at the deadline, and for background jobs to return
+// after they were cancelled.
+const closeGrace = 10 * time.Second
+
+// serve runs the HTTP server until SIGTERM/SIGINT, then drains in-flight requests
+// and background jobs before closing the DB pool. stopJobs is called to abort
+// background jobs that are still running when the deadline passes.
+func serve(addr string, handler http.Handler, stopJobs context.CancelFunc) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Done("starting server on %s", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-sigCtx.Done():
+	}
+	stop()
+	close(shutdownStarted)
+	stopBackground()
+
+	// Large saves can take minutes; see SHUTDOWN_TIMEOUT
+	timeout := cfg().ShutdownTimeout
+	pending := snapshotInFlight()
+	log.Info("shutdown: signal received, draining %d in-flight request(s) (deadline %s)", len(pending), timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Exiting closes the connections anyway; don't pull the pool out from
+	// under handlers or jobs that are still using it
+	closeDB := true
+
+	if err := srv.Shutdown(ctx); err != nil {
+		for _, req := range snapshotInFlight() {
+			log.Warn("shutdown: interrupting %s request %s from %s (running %s)", req.Route, req.RequestID, req.Remote, time.Since(req.Started).Round(time.Second))
+		}
+		log.Warn("shutdown: deadline exceeded, closing remaining connections: %v", err)
+		_ = srv.Close()
+		// Close doesn't wait for handlers; their request contexts are cancelled
+		// now, so give them a moment to return before the DB goes away
+		if !waitInFlight(closeGrace) {
+			closeDB = false
+			log.Warn("shutdown: %d request(s) still running after closing connections", len(snapshotInFlight()))
+		}
+	} else {
+		log.Info("shutdown: all requests drained")
+	}
+
+	jobsDone := make(chan struct{})
+	go func() {
+		backgroundJobs.Wait()
+		close(jobsDone)
+	}()
+	select {
+	case <-jobsDone:
+	case <-ctx.Done():
+		log.Warn("shutdown: background jobs still running at deadline, cancelling")
+		stopJobs()
+		// A job stuck outside its context can't hold up the exit
+		select {
+		case <-jobsDone:
+		case <-time.After(closeGrace):
+			closeDB = false
+			log.Warn("shutdown: background jobs still running after cancelling, exiting anyway")
+		}
+	}
+	schedulerLease.stopAndRelease()
+
+	if db := DB; db != nil && closeDB {
+		if err := db.Close(); err != nil {
+			log.Warn("shutdown: DB close error: %v", err)
+		}
+	}
+	log.Done("shutdown: complete")
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestGoBackgroundAfterStop(t *testing.T) {
+	t.Cleanup(func() {
+		backgroundMu.Lock()
+		backgroundStopped = false
+		backgroundMu.Unlock()
+	})
+
+	ran := make(chan struct{})
+	if !goBackground(func() { close(ran) }) {
+		t.Fatal("goBackground refused before shutdown")
+	}
+	<-ran
+
+	stopBackground()
+	if goBackground(func() { t.Error("ran after shutdown started") }) {
+		t.Error("goBackground accepted work after shutdown started")
+	}
+	backgroundJobs.Wait()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// statusHistoryLimit caps the ledger entries returned by /membership/status.
+const statusHistoryLimit = 50
+
+// membershipSummary is a linked membership as shown to its account. Lifetime
+// memberships have no expiry or days remaining.
+type membershipSummary struct {
+	Email         string     `json:"email"`
+	TierName      string     `json:"tierName"`
+	Active        bool       `json:"active"`
+	ExpiresAt     *time.Time `json:"expiresAt"`
+	DaysRemaining *int       `json:"daysRemaining"`
+}
+
+// renewal is a payments ledger entry as shown to the account. Transaction IDs
+// stay server side.
+type renewal struct {
+	Provider     string     `json:"provider"`
+	Type         string     `json:"type"`
+	TierName     string     `json:"tierName"`
+	Amount       string     `json:"amount"`
+	Currency     string     `json:"currency"`
+	Months       int        `json:"months"`
+	Days         int        `json:"days"`
+	Cancellation bool       `json:"cancellation"`
+	PaidAt       time.Time  `json:"paidAt"`
+	RefundedAt   *time.Time `json:"refundedAt"`
+	StartsAt     *time.Time `json:"startsAt"`
+	EndsAt       *time.Time `json:"endsAt"`
+}
+
+type membershipStatus struct {
+	Subscriber  bool                `json:"subscriber"`
+	Tier        *tier               `json:"tier"`
+	Memberships []membershipSummary `json:"memberships"`
+	History     []renewal           `json:"history"`
+}
+
+// maskEmail hides all but the first character of the local part of an email
+// address, e.g. p***@example.com.
+func maskEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// linkedMemberships returns the memberships linked to accountID, the one in
+// effect first.
+func linkedMemberships(ctx context.Context, db *sql.DB, accountID string) ([]membershipSummary, error) {
+	rows, err := db.QueryContext(ctx, `SELECT email, tier_name, expires_at, (expires_at > NOW() OR expires_at IS NULL) AS active
+		FROM memberships WHERE account_id = ?
+		ORDER BY active DESC, expires_at IS NULL DESC, expires_at DESC`, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("membership lookup: %w", err)
+	}
+	defer rows.Close()
+	memberships := []membershipSummary{}
+	for rows.Next() {
+		var m membershipSummary
+		var email, tierName sql.NullString
+		var expires sql.NullTime
+		if err := rows.Scan(&email, &tierName, &expires, &m.Active); err != nil {
+			return nil, fmt.Errorf("membership scan: %w", err)
+		}
+		m.Email, m.TierName = maskEmail(email.String), tierName.String
+		if expires.Valid {
+			days := daysUntil(expires.Time)
+			m.ExpiresAt, m.DaysRemaining = &expires.Time, &days
+		}
+		memberships = append(memberships, m)
+	}
+	return memberships, rows.Err()
+}
+
+// membershipHistory returns the most recent ledger entries of the memberships
+// linked to accountID, newest first.
+func membershipHistory(ctx context.Context, db *sql.DB, accountID string, limit int) ([]renewal, error) {
+	rows, err := db.QueryContext(ctx, `SELECT p.provider, p.type, COALESCE(p.tier_name, ''), p.amount, p.currency,
+			p.months, p.days, p.cancellation, p.paid_at, p.refunded_at, p.starts_at, p.ends_at
+		FROM payments p JOIN memberships m ON m.id = p.membership_id
+		WHERE m.account_id = ?
+		ORDER BY p.paid_at DESC, p.id DESC LIMIT ?`, accountID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("ledger lookup: %w", err)
+	}
+	defer rows.Close()
+	history := []renewal{}
+	for rows.Next() {
+		var e renewal
+		var refunded, starts, ends sql.NullTime
+		if err := rows.Scan(&e.Provider, &e.Type, &e.TierName, &e.Amount, &e.Currency, &e.Months, &e.Days, &e.Cancellation, &e.PaidAt, &refunded, &starts, &ends); err != nil {
+			return nil, fmt.Errorf("ledger scan: %w", err)
+		}
+		e.RefundedAt, e.StartsAt, e.EndsAt = nullTimePtr(refunded), nullTimePtr(starts), nullTimePtr(ends)
+		history = append(history, e)
+	}
+	return history, rows.Err()
+}
+
+func init() {
+	http.HandleFunc("/membership/status", membershipStatusHandler)
+}
+
+// membershipStatusHandler shows the caller its linked memberships, their
+// renewal history and the limits of its tier.
+func membershipStatusHandler(w http.ResponseWriter, r *http.Request) {
+	logger := log.FromContext(r.Context())
+	req, ok := decodeMembershipRequest(w, r)
+	if !ok {
+		return
+	}
+	logger = logger.With("account_id", req.AccountId)
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	db := DB
+	if db == nil {
+		logger.Error("membership: DB not initialized")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// Reads aren't audited, only refused attempts
+	audit := newAuditEvent(r, "membership_status", req.AccountId)
+	if !authorizeMembershipRequest(ctx, w, db, req, audit) {
+		audit.record()
+		return
+	}
+
+	var status membershipStatus
+	var subscriber sql.NullBool
+	err := db.QueryRowContext(ctx, "SELECT subscriber FROM accounts WHERE account_id = ?", req.AccountId).Scan(&subscriber)
+	if err != nil && err != sql.ErrNoRows {
+		logger.Error("membership: account lookup error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	status.Subscriber = subscriber.Bool
+
+	if status.Tier, err = accountTier(ctx, db, req.AccountId); err != nil {
+		logger.Error("membership: tier lookup error: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status.Memberships, err = linkedMemberships(ctx, db, req.AccountId); err != nil {
+		logger.Error("membership: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if status.History, err = membershipHistory(ctx, db, req.AccountId, statusHistoryLimit); err != nil {
+		logger.Error("membership: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
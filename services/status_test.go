@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMaskEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"player@example.com": "p***@example.com",
+		"a@b.co":             "a***@b.co",
+		"@example.com":       "***",
+		"":                   "***",
+	} {
+		if got := maskEmail(in); got != want {
+			t.Errorf("maskEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMembershipStatusHandlerValidation(t *testing.T) {
+	for _, tc := range []struct {
+		method, body string
+		want         int
+	}{
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, `{"accountId":"123"}`, http.StatusBadRequest},
+		{http.MethodPost, `not json`, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		membershipStatusHandler(rec, httptest.NewRequest(tc.method, "/membership/status", strings.NewReader(tc.body)))
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: status = %d, want %d", tc.method, tc.body, rec.Code, tc.want)
+		}
+	}
+}
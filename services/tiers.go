@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// Limits come from the tiers table. An account's tier is that of its linked
+// active membership (the one running longest if there are several), the
+// default paid tier for subscribers without one, and the free tier otherwise.
+// NULL columns fall back to the config: MAX_DATA_SIZE_BYTES and
+// CLEANUP_RETENTION_DAYS for the free tier, the SUBSCRIBER_ settings for paid
+// tiers. Rate limits of NULL or 0 are unlimited. There is no per-tier version
+// history depth: the server keeps a single backup per account, so there are no
+// older versions to limit.
+
+const freeTierName = "Free"
+
+// accountTierNameSQL evaluates to the tier name of the account aliased a.
+const accountTierNameSQL = `COALESCE(
+		(SELECT m.tier_name FROM memberships m WHERE m.account_id = a.account_id AND (m.expires_at > NOW() OR m.expires_at IS NULL)
+		 ORDER BY m.expires_at IS NULL DESC, m.expires_at DESC LIMIT 1),
+		IF(COALESCE(a.subscriber, 0) = 1, '` + defaultTierName + `', '` + freeTierName + `'))`
+
+// tierRetentionSQL evaluates to the retention in days of tier row t for tier
+// name x.tier_name, with the defaults bound by Config.tierRetentionArgs.
+const tierRetentionSQL = `COALESCE(t.retention_days, IF(x.tier_name = '` + freeTierName + `', ?, ?))`
+
+// tierQuotaSQL evaluates to the storage quota in bytes of tier row t for tier
+// name x.tier_name, with the defaults bound by Config.tierQuotaArgs.
+const tierQuotaSQL = `COALESCE(t.max_data_size_bytes, IF(x.tier_name = '` + freeTierName + `', ?, ?))`
+
+const tierColumns = "max_data_size_bytes, retention_days, saves_per_hour, loads_per_hour"
+
+type tier struct {
+	Name          string `json:"name"`
+	MaxDataSize   int    `json:"maxDataSize"`
+	RetentionDays int    `json:"retentionDays"`
+	SavesPerHour  int    `json:"savesPerHour"`
+	LoadsPerHour  int    `json:"loadsPerHour"`
+}
+
+// tierRow is a row of the tiers table as stored.
+type tierRow struct {
+	Name          string
+	MaxDataSize   sql.NullInt64
+	RetentionDays sql.NullInt64
+	SavesPerHour  sql.NullInt64
+	LoadsPerHour  sql.NullInt64
+}
+
+func (r *tierRow) scanDest() []any {
+	return []any{&r.MaxDataSize, &r.RetentionDays, &r.SavesPerHour, &r.LoadsPerHour}
+}
+
+// resolveTier fills in the config defaults for NULL columns of r.
+func (c *Config) resolveTier(r tierRow) *tier {
+	t := &tier{Name: r.Name, MaxDataSize: c.MaxDataSizeBytes, RetentionDays: c.CleanupRetentionDays}
+	if r.Name != freeTierName {
+		t.MaxDataSize = c.SubscriberMaxDataSizeBytes
+		t.RetentionDays = c.SubscriberRetentionDays
+	}
+	if r.MaxDataSize.Valid {
+		t.MaxDataSize = int(r.MaxDataSize.Int64)
+	}
+	if r.RetentionDays.Valid {
+		t.RetentionDays = int(r.RetentionDays.Int64)
+	}
+	t.SavesPerHour = int(r.SavesPerHour.Int64)
+	t.LoadsPerHour = int(r.LoadsPerHour.Int64)
+	return t
+}
+
+func (c *Config) tierRetentionArgs() []any {
+	return []any{c.CleanupRetentionDays, c.SubscriberRetentionDays}
+}
+
+func (c *Config) tierQuotaArgs() []any {
+	return []any{c.MaxDataSizeBytes, c.SubscriberMaxDataSizeBytes}
+}
+
+// paid reports whether t is a membership tier rather than the free tier.
+func (t *tier) paid() bool {
+	return t.Name != freeTierName
+}
+
+// backupExpiry returns when an account last active at lastActivity will be
+// moved to the trash by the cleanup. ok is false if it never expires.
+func (t *tier) backupExpiry(lastActivity time.Time) (expiresAt time.Time, ok bool) {
+	if t.RetentionDays <= 0 {
+		return time.Time{}, false
+	}
+	return lastActivity.AddDate(0, 0, t.RetentionDays), true
+}
+
+// rowQuerier is satisfied by both *sql.DB and *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlConn is satisfied by both *sql.DB and *sql.Tx.
+type sqlConn interface {
+	rowQuerier
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// accountTier returns the active tier of an account. Unknown accounts get the
+// free tier.
+func accountTier(ctx context.Context, db rowQuerier, accountID string) (*tier, error) {
+	row := tierRow{Name: freeTierName}
+	err := db.QueryRowContext(ctx, `SELECT x.tier_name, `+tierColumns+`
+		FROM (SELECT `+accountTierNameSQL+` AS tier_name FROM accounts a WHERE a.account_id = ?) x
+		LEFT JOIN tiers t ON t.name = x.tier_name`, accountID).Scan(append([]any{&row.Name}, row.scanDest()...)...)
+	if err == sql.ErrNoRows {
+		return cfg().resolveTier(tierRow{Name: freeTierName}), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tier lookup: %w", err)
+	}
+	return cfg().resolveTier(row), nil
+}
+
+// listTiers returns every tier with the config defaults applied.
+func listTiers(ctx context.Context, db *sql.DB) ([]*tier, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, "+tierColumns+" FROM tiers ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	conf := cfg()
+	out := []*tier{}
+	for rows.Next() {
+		var r tierRow
+		if err := rows.Scan(append([]any{&r.Name}, r.scanDest()...)...); err != nil {
+			return nil, err
+		}
+		out = append(out, conf.resolveTier(r))
+	}
+	return out, rows.Err()
+}
+
+// ensureTier registers a tier name seen in a payment or grant so memberships can
+// reference it. New tiers start with the subscriber defaults.
+func ensureTier(ctx context.Context, tx *sql.Tx, name string) error {
+	res, err := tx.ExecContext(ctx, "INSERT IGNORE INTO tiers (name) VALUES (?)", name)
+	if err != nil {
+		return fmt.Errorf("register tier: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.FromContext(ctx).Warn("tiers: registered new tier %q with default limits", name)
+	}
+	return nil
+}
+
+// setTier creates or updates a tier. nil limits are stored as NULL, i.e. the
+// config default.
+func setTier(ctx context.Context, db *sql.DB, name string, maxDataSize, retentionDays, savesPerHour, loadsPerHour *int) error {
+	_, err := db.ExecContext(ctx, `INSERT INTO tiers (name, `+tierColumns+`) VALUES (?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE max_data_size_bytes = VALUES(max_data_size_bytes),
+			retention_days = VALUES(retention_days), saves_per_hour = VALUES(saves_per_hour), loads_per_hour = VALUES(loads_per_hour)`,
+		name, maxDataSize, retentionDays, savesPerHour, loadsPerHour)
+	return err
+}
+
+// rateLimited reports whether the account has used up limit successful requests
+// of the given audit actions in the past hour. A limit of 0 is unlimited.
+func rateLimited(ctx context.Context, db *sql.DB, accountID string, limit int, actions ...string) (bool, error) {
+	if limit <= 0 || len(actions) == 0 {
+		return false, nil
+	}
+	args := []any{accountID}
+	for _, a := range actions {
+		args = append(args, a)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(actions)), ", ")
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM audit_events
+		WHERE account_id = ? AND action IN (`+placeholders+`) AND result = 'ok' AND created_at > DATE_SUB(NOW(), INTERVAL 1 HOUR)`, args...).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("rate limit lookup: %w", err)
+	}
+	return n >= limit, nil
+}
+
+// loadLimitReached reports whether the account has used up its tier's hourly
+// loads. /load and /loadlevel share the allowance.
+func loadLimitReached(ctx context.Context, db *sql.DB, accountID string) (bool, *tier, error) {
+	limits, err := accountTier(ctx, db, accountID)
+	if err != nil {
+		return false, nil, err
+	}
+	limited, err := rateLimited(ctx, db, accountID, limits.LoadsPerHour, "load", "loadlevel")
+	return limited, limits, err
+}
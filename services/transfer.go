@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/DumbCaveSpider/GDAlternativeWeb/log"
+)
+
+// A linked membership can be unlinked, or transferred to another registered
+// account, by the account it is linked to. To stop one membership being passed
+// around, linking or transferring it starts a cooldown of
+// MEMBERSHIP_TRANSFER_COOLDOWN_DAYS during which it can't be linked to or
+// transferred to another account. Unlinking is always allowed and doesn't
+// restart the cooldown. Memberships linked before this existed may move once
+// straight away. Operators can move memberships regardless through the admin
+// API and command line.
+
+// cooldownError refuses to move a membership before Until.
+type cooldownError struct {
+	Until time.Time
+}
+
+func (e *cooldownError) Error() string {
+	return "membership changed account recently, try again after " + e.Until.Format(time.RFC3339)
+}
+
+func (e *cooldownError) write(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(e.Until).Seconds())+1))
+	http.Error(w, "Membership was moved recently, try again after "+e.Until.Format(time.RFC3339), http.StatusTooManyRequests)
+}
+
+// checkTransferCooldown returns a cooldownError if a membership last changed
+// account at changedAt is still cooling down.
+func checkTransferCooldown(changedAt sql.NullTime) error {
+	days := cfg().TransferCooldownDays
+	if !changedAt.Valid || days <= 0 {
+		return nil
+	}
+	if until := changedAt.Time.AddDate(0, 0, days); until.After(time.Now()) {
+		return &cooldownError{Until: until}
+	}
+	return nil
+}
+
+// moveMemberships moves the memberships linked to from, only those for email if
+// it is set, to the account to, or unlinks them if to is empty. Subscriber
+// status and quota state of both accounts are recomputed. Unless force is set,
+// transfers of memberships still cooling down are refused with a
+// cooldownError. It returns
+// the number of memberships moved, errMembershipNotFound if there are none, or
+// errAccountNotFound if to doesn't exist.
+func moveMemberships(ctx context.Context, db *sql.DB, from, to, email string, force bool) (int64, error) {
+	if from == to {
+		return 0, fmt.Errorf("cannot transfer a membership to the account it is linked to")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "SELECT id, account_changed_at FROM memberships WHERE account_id = ?"
+	args := []any{from}
+	if email != "" {
+		query += " AND email = ?"
+		args = append(args, email)
+	}
+	rows, err := tx.QueryContext(ctx, query+" FOR UPDATE", args...)
+	if err != nil {
+		return 0, err
+	}
+	var ids []any
+	var latest sql.NullTime
+	for rows.Next() {
+		var id int64
+		var changedAt sql.NullTime
+		if err := rows.Scan(&id, &changedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		if changedAt.Valid && (!latest.Valid || changedAt.Time.After(latest.Time)) {
+			latest = changedAt
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, errMembershipNotFound
+	}
+	if !force && to != "" {
+		if err := checkTransferCooldown(latest); err != nil {
+			return 0, err
+		}
+	}
+	if to != "" {
+		var exists int
+		if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM accounts WHERE account_id = ?", to).Scan(&exists); err != nil {
+			return 0, err
+		}
+		if exists == 0 {
+			return 0, errAccountNotFound
+		}
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	res, err := tx.ExecContext(ctx, "UPDATE memberships SET account_changed_at = IF(? = '', account_changed_at, NOW()), account_id = NULLIF(?, '') WHERE id IN ("+placeholders+")", append([]any{to, to}, ids...)...)
+	if err != nil {
+		return 0, fmt.Errorf("move memberships: %w", err)
+	}
+	n, _ := res.RowsAffected()
+
+	for _, accountID := range []string{from, to} {
+		if accountID == "" {
+			continue
+		}
+		if err := refreshSubscriber(ctx, tx, accountID); err != nil {
+			return 0, err
+		}
+		if err := updateQuotaState(ctx, tx, accountID); err != nil {
+			return 0, err
+		}
+	}
+	return n, tx.Commit()
+}
+
+func init() {
+	http.HandleFunc("/membership/unlink", membershipTransferHandler(false))
+	http.HandleFunc("/membership/transfer", membershipTransferHandler(true))
+}
+
+// checkMoveTarget validates the target account of a transfer, and clears it
+// for an unlink. It returns the error message for a bad request, or "".
+func checkMoveTarget(req *MembershipRequest, transfer bool) string {
+	if !transfer {
+		req.TargetAccountId = ""
+		return ""
+	}
+	if req.TargetAccountId == "" {
+		return "Missing required field"
+	}
+	if req.TargetAccountId == req.AccountId {
+		return "Cannot transfer to the same account"
+	}
+	return ""
+}
+
+// membershipTransferHandler serves /membership/transfer, which needs
+// targetAccountId, and /membership/unlink. Both act on every membership linked
+// to the caller, or only those for email if given.
+func membershipTransferHandler(transfer bool) http.HandlerFunc {
+	action := "membership_unlink"
+	if transfer {
+		action = "membership_transfer"
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := log.FromContext(r.Context())
+		req, ok := decodeMembershipRequest(w, r)
+		if !ok {
+			return
+		}
+		if msg := checkMoveTarget(req, transfer); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		logger = logger.With("account_id", req.AccountId)
+
+		audit := newAuditEvent(r, action, req.AccountId)
+		audit.Detail = req.TargetAccountId
+		defer audit.record()
+
+		ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+		defer cancel()
+
+		db := DB
+		if db == nil {
+			logger.Error("membership: DB not initialized")
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !authorizeMembershipRequest(ctx, w, db, req, audit) {
+			return
+		}
+
+		n, err := moveMemberships(ctx, db, req.AccountId, req.TargetAccountId, req.Email, false)
+		var cooldown *cooldownError
+		switch {
+		case errors.Is(err, errMembershipNotFound):
+			audit.Result = "not_found"
+			http.Error(w, "No linked membership", http.StatusNotFound)
+			return
+		case errors.Is(err, errAccountNotFound):
+			audit.Result = "not_found"
+			http.Error(w, "Target account not found", http.StatusNotFound)
+			return
+		case errors.As(err, &cooldown):
+			logger.Warn("membership: %v", err)
+			audit.Result = "cooldown"
+			cooldown.write(w)
+			return
+		case err != nil:
+			logger.Error("membership: %s error: %v", action, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if transfer {
+			// Show up in the receiving account's history too
+			in := newAuditEvent(r, "membership_transfer_in", req.TargetAccountId)
+			in.Detail = req.AccountId
+			in.Result = "ok"
+			in.record()
+			logger.Info("membership: transferred %d membership(s) from %s to %s", n, req.AccountId, req.TargetAccountId)
+		} else {
+			logger.Info("membership: unlinked %d membership(s) from %s", n, req.AccountId)
+		}
+		audit.Result = "ok"
+		writeJSON(w, http.StatusOK, map[string]interface{}{"memberships": n})
+	}
+}
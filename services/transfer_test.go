@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckTransferCooldown(t *testing.T) {
+	withConfig(t, func(c *Config) { c.TransferCooldownDays = 30 })
+
+	if err := checkTransferCooldown(sql.NullTime{}); err != nil {
+		t.Errorf("never moved: %v", err)
+	}
+	if err := checkTransferCooldown(sql.NullTime{Time: time.Now().AddDate(0, 0, -31), Valid: true}); err != nil {
+		t.Errorf("moved 31 days ago: %v", err)
+	}
+	changed := time.Now().AddDate(0, 0, -10)
+	var cooldown *cooldownError
+	if err := checkTransferCooldown(sql.NullTime{Time: changed, Valid: true}); !errors.As(err, &cooldown) || !cooldown.Until.Equal(changed.AddDate(0, 0, 30)) {
+		t.Errorf("moved 10 days ago: %v", err)
+	}
+
+	withConfig(t, func(c *Config) { c.TransferCooldownDays = 0 })
+	if err := checkTransferCooldown(sql.NullTime{Time: time.Now(), Valid: true}); err != nil {
+		t.Errorf("cooldown disabled: %v", err)
+	}
+}
+
+func TestMembershipTransferHandlerValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		transfer bool
+		method   string
+		body     string
+		status   int
+	}{
+		{"wrong method", true, http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"missing token", false, http.MethodPost, `{"accountId":"1"}`, http.StatusBadRequest},
+		{"missing target", true, http.MethodPost, `{"accountId":"1","argonToken":"t"}`, http.StatusBadRequest},
+		{"same account", true, http.MethodPost, `{"accountId":"1","argonToken":"t","targetAccountId":"1"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			membershipTransferHandler(tt.transfer)(rec, httptest.NewRequest(tt.method, "/membership/transfer", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckMoveTarget(t *testing.T) {
+	req := &MembershipRequest{AccountId: "1", TargetAccountId: "1"}
+	if msg := checkMoveTarget(req, false); msg != "" || req.TargetAccountId != "" {
+		t.Errorf("unlink: %q, target %q", msg, req.TargetAccountId)
+	}
+	req = &MembershipRequest{AccountId: "1", TargetAccountId: "2"}
+	if msg := checkMoveTarget(req, true); msg != "" || req.TargetAccountId != "2" {
+		t.Errorf("transfer: %q, target %q", msg, req.TargetAccountId)
+	}
+}
+
+func TestDecodeMembershipRequest(t *testing.T) {
+	rec := httptest.NewRecorder()
+	body := `{"accountId":"1","argonToken":"t","email":"  player@example.com ","targetAccountId":"2"}`
+	req, ok := decodeMembershipRequest(rec, httptest.NewRequest(http.MethodPost, "/membership/transfer", strings.NewReader(body)))
+	if !ok {
+		t.Fatalf("rejected with %d", rec.Code)
+	}
+	if req.AccountId != "1" || req.ArgonToken != "t" || req.Email != "player@example.com" || req.TargetAccountId != "2" {
+		t.Errorf("decoded %+v", req)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Self-hosters can connect their own billing through /payment/webhook. The body
+// is a JSON payment signed with PAYMENT_WEBHOOK_SECRET:
+//
+//	X-Signature-256: sha256=<hex HMAC-SHA256 of the raw body>
+//
+//	{"transactionId": "inv_123", "email": "player@example.com", "amount": "5.00",
+//	 "currency": "USD", "tier": "Account Backup Extra", "months": 1}
+//
+// transactionId and email are required. Without months or days a payment buys
+// one month; tier defaults to Account Backup Extra and paidAt (RFC 3339) to now.
+// A refund repeats the transactionId of the refunded payment with "refund": true
+// and takes back the time it bought. "cancel": true with a new transactionId
+// ends the membership for email immediately.
+
+const signatureHeader = "X-Signature-256"
+
+type signedPayment struct {
+	TransactionID   string
+	Email           string
+	Amount          string
+	Currency        string
+	Tier            string
+	Months          int
+	Days            int
+	Refund          bool
+	Cancel          bool
+	PaidAt          string
+	DiscordUsername string
+	DiscordUserID   string
+}
+
+func (p *signedPayment) UnmarshalJSON(data []byte) error {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	get := func(keys ...string) string {
+		for _, k := range keys {
+			if v, ok := raw[k]; ok && v != nil {
+				switch t := v.(type) {
+				case string:
+					return t
+				case float64:
+					return strconv.FormatFloat(t, 'f', -1, 64)
+				default:
+					return fmt.Sprintf("%v", t)
+				}
+			}
+		}
+		return ""
+	}
+	getInt := func(keys ...string) (int, error) {
+		s := get(keys...)
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s must be a non-negative integer", keys[0])
+		}
+		return n, nil
+	}
+	var err error
+	p.TransactionID = get("transactionId", "transaction_id")
+	p.Email = get("email")
+	p.Amount = get("amount")
+	p.Currency = get("currency")
+	p.Tier = get("tier", "tierName", "tier_name")
+	if p.Months, err = getInt("months"); err != nil {
+		return err
+	}
+	if p.Days, err = getInt("days"); err != nil {
+		return err
+	}
+	p.Refund, _ = strconv.ParseBool(get("refund"))
+	p.Cancel, _ = strconv.ParseBool(get("cancel"))
+	if p.Refund && p.Cancel {
+		return errors.New("refund and cancel are mutually exclusive")
+	}
+	p.PaidAt = get("paidAt", "paid_at")
+	p.DiscordUsername = get("discordUsername", "discord_username")
+	p.DiscordUserID = get("discordUserId", "discord_userid")
+	return nil
+}
+
+// verifyWebhookSignature checks header against the HMAC-SHA256 of body in
+// constant time. It fails if no secret is configured.
+func verifyWebhookSignature(secret string, body []byte, header string) bool {
+	if secret == "" {
+		return false
+	}
+	got, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// signedWebhookProvider accepts payments signed with PAYMENT_WEBHOOK_SECRET.
+type signedWebhookProvider struct{}
+
+func (signedWebhookProvider) Name() string { return "webhook" }
+
+func (signedWebhookProvider) ParseWebhook(r *http.Request, body []byte) (*paymentEvent, error) {
+	secret := cfg().PaymentWebhookSecret
+	if secret == "" {
+		return nil, verificationFailed("Webhook disabled", errors.New("PAYMENT_WEBHOOK_SECRET is not set"))
+	}
+	if !verifyWebhookSignature(secret, body, r.Header.Get(signatureHeader)) {
+		return nil, verificationFailed("Invalid signature", errors.New("signature mismatch"))
+	}
+
+	var p signedPayment
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, invalidPayload(err)
+	}
+	if p.TransactionID == "" || p.Email == "" {
+		return nil, invalidPayload(errors.New("transactionId and email are required"))
+	}
+
+	ev := &paymentEvent{
+		TransactionID:   p.TransactionID,
+		Type:            "Payment",
+		Email:           p.Email,
+		Amount:          p.Amount,
+		Currency:        p.Currency,
+		Tier:            strings.TrimSpace(p.Tier),
+		Months:          p.Months,
+		Days:            p.Days,
+		Refund:          p.Refund,
+		Cancel:          p.Cancel,
+		PaidAt:          time.Now(),
+		DiscordUsername: p.DiscordUsername,
+		DiscordUserID:   p.DiscordUserID,
+	}
+	if ev.Tier == "" {
+		ev.Tier = defaultTierName
+	}
+	switch {
+	case ev.Refund:
+		ev.Type = "Refund"
+	case ev.Cancel:
+		ev.Type = "Cancellation"
+		ev.Months, ev.Days = 0, 0
+	case ev.Months == 0 && ev.Days == 0:
+		ev.Months = 1
+	}
+	if p.PaidAt != "" {
+		t, err := time.Parse(time.RFC3339, p.PaidAt)
+		if err != nil {
+			return nil, invalidPayload(fmt.Errorf("paidAt: %w", err))
+		}
+		if t.Before(ev.PaidAt) {
+			ev.PaidAt = t
+		}
+	}
+	return ev, nil
+}